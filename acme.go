@@ -0,0 +1,308 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	// ACMEChallengePath is the URL path prefix of HTTP-01 challenge responses.
+	ACMEChallengePath = "/.well-known/acme-challenge/"
+
+	// ACMEDNSPrefix is prepended to a domain to form its DNS-01 record name.
+	ACMEDNSPrefix = "_acme-challenge."
+
+	DefaultACMEDirectory = acme.LetsEncryptURL
+	DefaultACMEHTTPAddr  = ":80"
+)
+
+// DNSProvider publishes DNS-01 challenge TXT records.
+type DNSProvider interface {
+	// Present creates a TXT record named fqdn with value, and returns once
+	// it is visible to the ACME server.
+	Present(ctx context.Context, fqdn, value string) error
+	// CleanUp removes a record created by Present.
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+// ExecDNSProvider is a DNSProvider that runs a shell command for every
+// record. The command gets CERTSYNC_ACME_ACTION ("present" or "cleanup"),
+// CERTSYNC_ACME_RECORD and CERTSYNC_ACME_VALUE in its environment.
+type ExecDNSProvider struct {
+	Command string
+	Timeout time.Duration
+}
+
+func (p *ExecDNSProvider) run(ctx context.Context, action, fqdn, value string) error {
+	out, err := RunHook(ctx, p.Command, p.Timeout,
+		"CERTSYNC_ACME_ACTION="+action,
+		"CERTSYNC_ACME_RECORD="+fqdn,
+		"CERTSYNC_ACME_VALUE="+value,
+	)
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Present implements DNSProvider.
+func (p *ExecDNSProvider) Present(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "present", fqdn, value)
+}
+
+// CleanUp implements DNSProvider.
+func (p *ExecDNSProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "cleanup", fqdn, value)
+}
+
+// ACMEIssuer obtains certificates from an ACME (RFC 8555) CA. DNS-01 is used
+// if DNS is set, otherwise HTTP-01, for which the issuer must be served at
+// ACMEChallengePath on port 80 of every domain.
+type ACMEIssuer struct {
+	Client  *acme.Client
+	Email   string
+	KeyType string
+	DNS     DNSProvider
+
+	mu         sync.Mutex
+	registered bool
+	tokens     map[string]string
+}
+
+// NewACMEIssuer returns an issuer for the ACME directory URL. The account key
+// is read from accountKeyFile, which is created if it does not exist. roots,
+// if not nil, replaces the system roots for connections to the directory,
+// e.g. for testing against pebble.
+func NewACMEIssuer(directory, accountKeyFile string, roots *x509.CertPool) (*ACMEIssuer, error) {
+	if _, err := os.Stat(accountKeyFile); errors.Is(err, os.ErrNotExist) {
+		key, err := GenerateKey(KeyECDSAP256)
+		if err != nil {
+			return nil, err
+		}
+		keyPEM, err := EncodeKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := WriteAtomic(AtomicFile{Name: accountKeyFile, Data: keyPEM, Mode: 0600}); err != nil {
+			return nil, fmt.Errorf("cannot write ACME account key: %v", err)
+		}
+	}
+	key, err := ReadPrivateKey(accountKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	c := &acme.Client{Key: key, DirectoryURL: directory, UserAgent: "certsync"}
+	if roots != nil {
+		c.HTTPClient = &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+		}}
+	}
+	return &ACMEIssuer{Client: c, KeyType: DefaultKeyType, tokens: make(map[string]string)}, nil
+}
+
+// ServeHTTP answers HTTP-01 challenges for pending authorizations.
+func (a *ACMEIssuer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.URL.Path, ACMEChallengePath)
+	a.mu.Lock()
+	resp, found := a.tokens[token]
+	a.mu.Unlock()
+	if !ok || !found {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(resp))
+}
+
+func (a *ACMEIssuer) setToken(token, resp string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if resp == "" {
+		delete(a.tokens, token)
+		return
+	}
+	a.tokens[token] = resp
+}
+
+func (a *ACMEIssuer) register(ctx context.Context) error {
+	a.mu.Lock()
+	registered := a.registered
+	a.mu.Unlock()
+	if registered {
+		return nil
+	}
+	acct := &acme.Account{}
+	if a.Email != "" {
+		acct.Contact = []string{"mailto:" + a.Email}
+	}
+	if _, err := a.Client.Register(ctx, acct, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return fmt.Errorf("cannot register ACME account: %v", err)
+	}
+	a.mu.Lock()
+	a.registered = true
+	a.mu.Unlock()
+	return nil
+}
+
+// authorize completes one authorization of an order.
+func (a *ACMEIssuer) authorize(ctx context.Context, url string) error {
+	z, err := a.Client.GetAuthorization(ctx, url)
+	if err != nil {
+		return err
+	}
+	if z.Status == acme.StatusValid {
+		return nil
+	}
+	typ := "http-01"
+	if a.DNS != nil {
+		typ = "dns-01"
+	}
+	var chal *acme.Challenge
+	for _, c := range z.Challenges {
+		if c.Type == typ {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("no %s challenge offered for %q", typ, z.Identifier.Value)
+	}
+
+	switch typ {
+	case "dns-01":
+		value, err := a.Client.DNS01ChallengeRecord(chal.Token)
+		if err != nil {
+			return err
+		}
+		fqdn := ACMEDNSPrefix + z.Identifier.Value
+		if err := a.DNS.Present(ctx, fqdn, value); err != nil {
+			return fmt.Errorf("cannot present DNS record %q: %v", fqdn, err)
+		}
+		defer a.DNS.CleanUp(context.WithoutCancel(ctx), fqdn, value)
+	default:
+		resp, err := a.Client.HTTP01ChallengeResponse(chal.Token)
+		if err != nil {
+			return err
+		}
+		a.setToken(chal.Token, resp)
+		defer a.setToken(chal.Token, "")
+	}
+
+	if _, err := a.Client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("cannot accept %s challenge for %q: %v", typ, z.Identifier.Value, err)
+	}
+	if _, err := a.Client.WaitAuthorization(ctx, z.URI); err != nil {
+		return fmt.Errorf("authorization for %q failed: %v", z.Identifier.Value, err)
+	}
+	return nil
+}
+
+// Obtain orders a certificate for domains with a new key, and returns the PEM
+// encoded chain and key.
+func (a *ACMEIssuer) Obtain(ctx context.Context, domains []string) (certPEM, keyPEM []byte, err error) {
+	if len(domains) == 0 {
+		return nil, nil, errors.New("no domains to order a certificate for")
+	}
+	if err := a.register(ctx); err != nil {
+		return nil, nil, err
+	}
+	order, err := a.Client.AuthorizeOrder(ctx, acme.DomainIDs(domains...))
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot create ACME order for %q: %v", domains, err)
+	}
+	for _, url := range order.AuthzURLs {
+		if err := a.authorize(ctx, url); err != nil {
+			return nil, nil, err
+		}
+	}
+	order, err = a.Client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ACME order for %q failed: %v", domains, err)
+	}
+
+	key, err := GenerateKey(a.KeyType)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domains[0]},
+		DNSNames: domains,
+	}, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot create certificate request: %v", err)
+	}
+	chain, _, err := a.Client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot finalize ACME order for %q: %v", domains, err)
+	}
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: PEMTypeCertificate, Bytes: der})...)
+	}
+	keyPEM, err = EncodeKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certPEM, keyPEM, nil
+}
+
+// Renew obtains a certificate for the bundle's ACME domains if its
+// certificate is missing, does not cover them, or is past DefaultRenewFraction
+// of its lifetime. It reports whether new files were written.
+func (a *ACMEIssuer) Renew(ctx context.Context, b *Bundle) (bool, error) {
+	if cert, err := ReadCertificate(b.CertFile); err == nil && coversDomains(cert, b.ACME) &&
+		time.Now().Before(RenewalTime(cert, DefaultRenewFraction, 0)) {
+		return false, nil
+	}
+	certPEM, keyPEM, err := a.Obtain(ctx, b.ACME)
+	if err != nil {
+		return false, fmt.Errorf("cannot obtain certificate for bundle %q: %v", b.Name, err)
+	}
+	err = WriteAtomic(
+		AtomicFile{Name: b.CertFile, Data: certPEM, Mode: 0644},
+		AtomicFile{Name: b.KeyFile, Data: keyPEM, Mode: 0600},
+	)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func coversDomains(cert *x509.Certificate, domains []string) bool {
+	for _, d := range domains {
+		if !slices.ContainsFunc(cert.DNSNames, func(n string) bool { return strings.EqualFold(n, d) }) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,160 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecDNSProvider(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "records")
+	p := &ExecDNSProvider{
+		Command: `echo "$CERTSYNC_ACME_ACTION $CERTSYNC_ACME_RECORD $CERTSYNC_ACME_VALUE" >> ` + out,
+		Timeout: time.Second,
+	}
+	ctx := context.Background()
+	if err := p.Present(ctx, "_acme-challenge.example.com", "value"); err != nil {
+		t.Fatalf("Present(): %v", err)
+	}
+	if err := p.CleanUp(ctx, "_acme-challenge.example.com", "value"); err != nil {
+		t.Fatalf("CleanUp(): %v", err)
+	}
+	got, _ := os.ReadFile(out)
+	if want := "present _acme-challenge.example.com value\ncleanup _acme-challenge.example.com value\n"; string(got) != want {
+		t.Errorf("ExecDNSProvider records: want: %q, got: %q", want, got)
+	}
+
+	p.Command = "echo no such zone; exit 1"
+	if err := p.Present(ctx, "_acme-challenge.example.com", "value"); err == nil || !strings.Contains(err.Error(), "no such zone") {
+		t.Errorf("Present(failing command): want error with output, got: %v", err)
+	}
+}
+
+func TestACMEIssuerServeHTTP(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "account.key")
+	a, err := NewACMEIssuer("https://acme.invalid/directory", keyFile, nil)
+	if err != nil {
+		t.Fatalf("NewACMEIssuer(): %v", err)
+	}
+	again, err := NewACMEIssuer("https://acme.invalid/directory", keyFile, nil)
+	if err != nil {
+		t.Fatalf("NewACMEIssuer(existing key): %v", err)
+	}
+	if !again.Client.Key.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(a.Client.Key.Public()) {
+		t.Errorf("NewACMEIssuer(existing key): account key was not reused")
+	}
+
+	a.setToken("token", "token.thumbprint")
+	var tests = []struct {
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{path: ACMEChallengePath + "token", wantStatus: http.StatusOK, wantBody: "token.thumbprint"},
+		{path: ACMEChallengePath + "other", wantStatus: http.StatusNotFound},
+		{path: "/token", wantStatus: http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if w.Code != tc.wantStatus || (tc.wantBody != "" && w.Body.String() != tc.wantBody) {
+			t.Errorf("ServeHTTP(%q): want: %d %q, got: %d %q", tc.path, tc.wantStatus, tc.wantBody, w.Code, w.Body.String())
+		}
+	}
+
+	a.setToken("token", "")
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, httptest.NewRequest(http.MethodGet, ACMEChallengePath+"token", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("ServeHTTP(removed token): want: %d, got: %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestACMEIssuerRenew(t *testing.T) {
+	dir := t.TempDir()
+	_, leaf := newTestChain(t, "host.example.com")
+	b := &Bundle{
+		Name:     "web",
+		CertFile: writeFile(t, dir, "cert.pem", string(leaf.certPEM)),
+		KeyFile:  writeFile(t, dir, "key.pem", string(leaf.keyPEM)),
+		ACME:     []string{"HOST.example.com"},
+	}
+	// Nothing listens on the directory URL, so any order fails.
+	a, err := NewACMEIssuer("http://127.0.0.1:1/directory", filepath.Join(dir, "account.key"), nil)
+	if err != nil {
+		t.Fatalf("NewACMEIssuer(): %v", err)
+	}
+
+	if renewed, err := a.Renew(context.Background(), b); renewed || err != nil {
+		t.Errorf("Renew(fresh certificate): want: false, got: %v (err: %v)", renewed, err)
+	}
+	b.ACME = append(b.ACME, "www.example.com")
+	if renewed, err := a.Renew(context.Background(), b); renewed || err == nil {
+		t.Errorf("Renew(new domain): want error, got: %v (err: %v)", renewed, err)
+	}
+}
+
+// TestACMEObtain runs against an ACME test server such as pebble, started
+// with PEBBLE_VA_ALWAYS_VALID=1:
+//
+//	CERTSYNC_TEST_ACME_DIRECTORY=https://localhost:14000/dir \
+//	CERTSYNC_TEST_ACME_CA=test/certs/pebble.minica.pem go test -run ACME
+func TestACMEObtain(t *testing.T) {
+	directory := os.Getenv("CERTSYNC_TEST_ACME_DIRECTORY")
+	if directory == "" {
+		t.Skip("CERTSYNC_TEST_ACME_DIRECTORY not set")
+	}
+	var roots *x509.CertPool
+	if f := os.Getenv("CERTSYNC_TEST_ACME_CA"); f != "" {
+		var err error
+		if roots, err = LoadCertPool(f); err != nil {
+			t.Fatalf("LoadCertPool(): %v", err)
+		}
+	}
+	a, err := NewACMEIssuer(directory, filepath.Join(t.TempDir(), "account.key"), roots)
+	if err != nil {
+		t.Fatalf("NewACMEIssuer(): %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	domains := []string{"acme.example.com", "www.acme.example.com"}
+	certPEM, _, err := a.Obtain(ctx, domains)
+	if err != nil {
+		t.Fatalf("Obtain(%q): %v", domains, err)
+	}
+	blocks, err := ParsePEM(certPEM)
+	if err != nil {
+		t.Fatalf("ParsePEM(): %v", err)
+	}
+	cert, err := x509.ParseCertificate(blocks[0].Bytes)
+	if err != nil {
+		t.Fatalf("cannot parse obtained certificate: %v", err)
+	}
+	if !coversDomains(cert, domains) {
+		t.Errorf("Obtain(%q): certificate names: %q", domains, cert.DNSNames)
+	}
+}
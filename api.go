@@ -0,0 +1,106 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// BundlePathV1 is the server endpoint that returns a BundleResponse.
+	BundlePathV1 = "/v1/bundle"
+
+	// BundleResponseVersion is the format version of BundleResponse.
+	BundleResponseVersion = 1
+
+	ContentTypeJSON = "application/json"
+	ContentTypePEM  = "application/x-pem-file"
+)
+
+// BundleResponse is the JSON form of a bundle. All certificates and the key
+// are PEM encoded.
+type BundleResponse struct {
+	Version     int       `json:"version"`
+	Name        string    `json:"name"`
+	Leaf        string    `json:"leaf"`
+	Chain       []string  `json:"chain,omitempty"`
+	Key         string    `json:"key"`
+	KeyWrap     string    `json:"key_wrap,omitempty"`
+	Fingerprint string    `json:"fingerprint"`
+	Serial      string    `json:"serial"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`
+}
+
+// ErrorResponse is the JSON body of API errors.
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// NewBundleResponse returns the BundleResponse for the PEM data of the named
+// bundle. The first certificate in data is the leaf.
+func NewBundleResponse(name string, data []byte) (*BundleResponse, error) {
+	certPEM, keyPEM, _, err := SplitBundle(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(keyPEM) == 0 {
+		return nil, fmt.Errorf("no %q PEM block in bundle %q", PEMTypePrivateKey, name)
+	}
+	blocks, err := ParsePEM(certPEM)
+	if err != nil {
+		return nil, fmt.Errorf("no certificate in bundle %q", name)
+	}
+	leaf, err := x509.ParseCertificate(blocks[0].Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse certificate of bundle %q: %v", name, err)
+	}
+	r := &BundleResponse{
+		Version:     BundleResponseVersion,
+		Name:        name,
+		Leaf:        string(pem.EncodeToMemory(blocks[0])),
+		Key:         string(keyPEM),
+		Fingerprint: Fingerprint(certPEM, keyPEM),
+		Serial:      fmt.Sprintf("%x", leaf.SerialNumber),
+		NotBefore:   leaf.NotBefore,
+		NotAfter:    leaf.NotAfter,
+	}
+	for _, b := range blocks[1:] {
+		r.Chain = append(r.Chain, string(pem.EncodeToMemory(b)))
+	}
+	return r, nil
+}
+
+// PEM returns the bundle in the format served at "/": the leaf, the chain and
+// the key.
+func (r *BundleResponse) PEM() ([]byte, error) {
+	if r.Version != BundleResponseVersion {
+		return nil, fmt.Errorf("unsupported bundle response version %d", r.Version)
+	}
+	if r.Leaf == "" || r.Key == "" {
+		return nil, errors.New("bundle response without leaf certificate or key")
+	}
+	data := []byte(r.Leaf)
+	for _, c := range r.Chain {
+		data = append(data, c...)
+	}
+	return append(data, r.Key...), nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestBundleResponse(t *testing.T) {
+	ca, leaf := newTestChain(t, "host.example.com")
+	data := append(append(append([]byte{}, leaf.certPEM...), ca.certPEM...), leaf.keyPEM...)
+
+	r, err := NewBundleResponse("web", data)
+	if err != nil {
+		t.Fatalf("NewBundleResponse(): %v", err)
+	}
+	wantFP, _ := BundleFingerprint(data)
+	if r.Leaf != string(leaf.certPEM) || len(r.Chain) != 1 || r.Chain[0] != string(ca.certPEM) || r.Key != string(leaf.keyPEM) {
+		t.Errorf("NewBundleResponse(): wrong PEM fields: %+v", r)
+	}
+	if r.Version != BundleResponseVersion || r.Name != "web" || r.Fingerprint != wantFP || !r.NotAfter.Equal(leaf.cert.NotAfter) {
+		t.Errorf("NewBundleResponse(): wrong metadata: %+v", r)
+	}
+
+	encoded, err := json.Marshal(r)
+	if err != nil {
+		t.Fatalf("json.Marshal(): %v", err)
+	}
+	var decoded BundleResponse
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatalf("json.Unmarshal(): %v", err)
+	}
+	got, err := decoded.PEM()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("PEM(): want: %q, got: %q (err: %v)", data, got, err)
+	}
+
+	decoded.Version = BundleResponseVersion + 1
+	if _, err := decoded.PEM(); err == nil {
+		t.Errorf("PEM(unknown version): want error, got nil")
+	}
+	if _, err := NewBundleResponse("web", leaf.certPEM); err == nil {
+		t.Errorf("NewBundleResponse(no key): want error, got nil")
+	}
+	if _, err := NewBundleResponse("web", leaf.keyPEM); err == nil {
+		t.Errorf("NewBundleResponse(no certificate): want error, got nil")
+	}
+}
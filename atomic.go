@@ -0,0 +1,144 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// AtomicFile is a file to be written by WriteAtomic.
+type AtomicFile struct {
+	Name string
+	Data []byte
+	Mode os.FileMode
+}
+
+type pendingFile struct {
+	AtomicFile
+	tmp, backup string
+	// created is set if the destination did not exist before.
+	created bool
+}
+
+// WriteAtomic writes all files to temporary files in their destination
+// directories, syncs them and only then renames them into place. If any write
+// fails, no destination file is touched. If a rename fails, destinations that
+// were already replaced are restored, and those that did not exist are
+// removed.
+func WriteAtomic(files ...AtomicFile) (err error) {
+	var pending []*pendingFile
+
+	defer func() {
+		for _, p := range pending {
+			if p.tmp != "" {
+				os.Remove(p.tmp)
+			}
+			if p.backup != "" {
+				os.Remove(p.backup)
+			}
+		}
+	}()
+
+	for _, f := range files {
+		tmp, err := writeTemp(f)
+		if err != nil {
+			return err
+		}
+		pending = append(pending, &pendingFile{AtomicFile: f, tmp: tmp})
+	}
+
+	// Keep hard links to the current files so they can be put back if a later
+	// rename fails. Filesystems without hard links just lose the rollback.
+	for _, p := range pending {
+		if _, err := os.Lstat(p.Name); errors.Is(err, os.ErrNotExist) {
+			p.created = true
+			continue
+		}
+		backup := p.tmp + ".old"
+		if err := os.Link(p.Name, backup); err == nil {
+			p.backup = backup
+		}
+	}
+
+	for i, p := range pending {
+		if err := os.Rename(p.tmp, p.Name); err != nil {
+			err = fmt.Errorf("cannot rename %q to %q: %v", p.tmp, p.Name, err)
+			for _, done := range pending[:i] {
+				switch {
+				case done.created:
+					if rerr := os.Remove(done.Name); rerr != nil {
+						err = errors.Join(err, fmt.Errorf("cannot remove %q: %v", done.Name, rerr))
+					}
+				case done.backup != "":
+					if rerr := os.Rename(done.backup, done.Name); rerr != nil {
+						err = errors.Join(err, fmt.Errorf("cannot restore %q: %v", done.Name, rerr))
+					}
+				}
+			}
+			return err
+		}
+		p.tmp = ""
+	}
+
+	for _, p := range pending {
+		if err := syncDir(filepath.Dir(p.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeTemp(f AtomicFile) (string, error) {
+	t, err := os.CreateTemp(filepath.Dir(f.Name), "."+filepath.Base(f.Name)+".tmp*")
+	if err != nil {
+		return "", fmt.Errorf("cannot create temporary file for %q: %v", f.Name, err)
+	}
+	tmp := t.Name()
+	err = func() error {
+		defer t.Close()
+		if err := t.Chmod(f.Mode); err != nil {
+			return err
+		}
+		if _, err := t.Write(f.Data); err != nil {
+			return err
+		}
+		if err := t.Sync(); err != nil {
+			return err
+		}
+		return t.Close()
+	}()
+	if err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("cannot write temporary file for %q: %v", f.Name, err)
+	}
+	return tmp, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("cannot open directory %q: %v", dir, err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("cannot sync directory %q: %v", dir, err)
+	}
+	return nil
+}
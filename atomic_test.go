@@ -0,0 +1,93 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteAtomic(t *testing.T) {
+	dir := t.TempDir()
+	cert := writeFile(t, dir, "cert.pem", "old cert")
+	key := filepath.Join(dir, "key.pem")
+
+	err := WriteAtomic(
+		AtomicFile{Name: cert, Data: []byte("new cert"), Mode: 0644},
+		AtomicFile{Name: key, Data: []byte("new key"), Mode: 0600},
+	)
+	if err != nil {
+		t.Fatalf("WriteAtomic(): %v", err)
+	}
+	for name, want := range map[string]string{cert: "new cert", key: "new key"} {
+		if got, err := os.ReadFile(name); err != nil || string(got) != want {
+			t.Errorf("WriteAtomic(): %q: want: %q, got: %q (err: %v)", name, want, got, err)
+		}
+	}
+	if fi, err := os.Stat(key); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("WriteAtomic(): %q: want mode 0600, got: %v (err: %v)", key, fi.Mode().Perm(), err)
+	}
+
+	// A failure on the second file must leave the first one untouched.
+	err = WriteAtomic(
+		AtomicFile{Name: cert, Data: []byte("newer cert"), Mode: 0644},
+		AtomicFile{Name: filepath.Join(dir, "missing", "key.pem"), Data: []byte("newer key"), Mode: 0600},
+	)
+	if err == nil {
+		t.Errorf("WriteAtomic(missing directory): want error, got nil")
+	}
+	if got, _ := os.ReadFile(cert); string(got) != "new cert" {
+		t.Errorf("WriteAtomic(missing directory): %q was modified to %q", cert, got)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Errorf("WriteAtomic(): want only 2 files left in %q, got %d", dir, len(entries))
+	}
+}
+
+func TestWriteAtomicRollback(t *testing.T) {
+	dir := t.TempDir()
+	cert := writeFile(t, dir, "cert.pem", "old cert")
+	chain := filepath.Join(dir, "chain.pem")
+	// A directory in place of the key makes its rename fail.
+	key := filepath.Join(dir, "key.pem")
+	if err := os.Mkdir(key, 0700); err != nil {
+		t.Fatalf("cannot create %q: %v", key, err)
+	}
+	writeFile(t, key, "keep", "")
+
+	err := WriteAtomic(
+		AtomicFile{Name: cert, Data: []byte("new cert"), Mode: 0644},
+		AtomicFile{Name: chain, Data: []byte("new chain"), Mode: 0644},
+		AtomicFile{Name: key, Data: []byte("new key"), Mode: 0600},
+	)
+	if err == nil {
+		t.Fatalf("WriteAtomic(key is a directory): want error, got nil")
+	}
+	if got, err := os.ReadFile(cert); err != nil || string(got) != "old cert" {
+		t.Errorf("WriteAtomic(key is a directory): %q: want: %q, got: %q (err: %v)", cert, "old cert", got, err)
+	}
+	if _, err := os.Stat(chain); !os.IsNotExist(err) {
+		t.Errorf("WriteAtomic(key is a directory): %q did not exist before and must be removed, got: %v", chain, err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Errorf("WriteAtomic(key is a directory): want only 2 entries left in %q, got %d", dir, len(entries))
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxAuditLine bounds the length of an audit record when reading the log.
+const maxAuditLine = 1 << 20
+
+// ErrAuditChain is returned when a hash chained audit log has been altered.
+var ErrAuditChain = errors.New("audit log hash chain broken")
+
+// AuditRecord is one line of the audit log.
+type AuditRecord struct {
+	Time              time.Time `json:"time"`
+	Handler           string    `json:"handler,omitempty"`
+	Method            string    `json:"method"`
+	Path              string    `json:"path"`
+	RemoteAddr        string    `json:"remote_addr"`
+	SourceIP          string    `json:"source_ip,omitempty"`
+	XFF               string    `json:"xff,omitempty"`
+	Identity          string    `json:"identity,omitempty"`
+	Subject           string    `json:"subject,omitempty"`
+	ChainFingerprint  string    `json:"chain_fingerprint,omitempty"`
+	Result            string    `json:"result"`
+	Reason            string    `json:"reason,omitempty"`
+	Bundle            string    `json:"bundle,omitempty"`
+	BundleFingerprint string    `json:"bundle_fingerprint,omitempty"`
+	Serial            string    `json:"serial,omitempty"`
+	KeyWrap           string    `json:"key_wrap,omitempty"`
+	Status            int       `json:"status"`
+	Bytes             int64     `json:"bytes"`
+	Latency           float64   `json:"latency_seconds"`
+	PrevHash          string    `json:"prev_hash,omitempty"`
+	Hash              string    `json:"hash,omitempty"`
+}
+
+// ChainFingerprint returns the Fingerprint of the DER encoded certificates of
+// chain, leaf first.
+func ChainFingerprint(chain []*x509.Certificate) string {
+	var der [][]byte
+	for _, c := range chain {
+		der = append(der, c.Raw)
+	}
+	return Fingerprint(der...)
+}
+
+// SetBundle records the fingerprint and the leaf serial number of the PEM data
+// of the named bundle.
+func (rec *AuditRecord) SetBundle(name string, data []byte) {
+	rec.Bundle = name
+	rec.BundleFingerprint, _ = BundleFingerprint(data)
+	if blocks, err := ParsePEM(data); err == nil {
+		for _, b := range blocks {
+			if b.Type != PEMTypeCertificate {
+				continue
+			}
+			if cert, err := x509.ParseCertificate(b.Bytes); err == nil {
+				rec.Serial = fmt.Sprintf("%x", cert.SerialNumber)
+			}
+			break
+		}
+	}
+}
+
+// hash returns the hash of rec, which covers the hash of the previous record.
+func (rec AuditRecord) hash() (string, error) {
+	rec.Hash = ""
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// AuditLog appends AuditRecords to a file, one JSON object per line. If hash
+// chaining is enabled, every record carries the hash of the previous one and
+// its own, so that removing or altering records is detected by
+// VerifyAuditLog.
+type AuditLog struct {
+	mu    sync.Mutex
+	f     *os.File
+	chain bool
+	last  string
+}
+
+// OpenAuditLog opens fileName for appending, creating it if needed. With
+// chain, the chain continues from the last record already in the file. A file
+// that holds unchained records is refused, as it would never pass
+// VerifyAuditLog: start a new file when turning chaining on.
+func OpenAuditLog(fileName string, chain bool) (*AuditLog, error) {
+	f, err := os.OpenFile(fileName, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	a := &AuditLog{f: f, chain: chain}
+	if chain {
+		if a.last, err = lastAuditHash(f); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("cannot read audit log %q: %v", fileName, err)
+		}
+	}
+	return a, nil
+}
+
+// lastAuditHash returns the hash of the last record read from r, which must
+// all be chained.
+func lastAuditHash(r io.Reader) (string, error) {
+	var (
+		n    int
+		last string
+	)
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, maxAuditLine)
+	for s.Scan() {
+		n++
+		var rec AuditRecord
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			return "", fmt.Errorf("record %d: %v", n, err)
+		}
+		if rec.Hash == "" {
+			return "", fmt.Errorf("record %d is not chained, start a new file for a chained log", n)
+		}
+		last = rec.Hash
+	}
+	return last, s.Err()
+}
+
+// Write appends rec to the log, filling in the hashes if chaining is enabled.
+func (a *AuditLog) Write(rec *AuditRecord) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.chain {
+		rec.PrevHash = a.last
+		h, err := rec.hash()
+		if err != nil {
+			return err
+		}
+		rec.Hash = h
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := a.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	a.last = rec.Hash
+	return nil
+}
+
+// Close closes the log file.
+func (a *AuditLog) Close() error {
+	return a.f.Close()
+}
+
+// VerifyAuditLog checks the hash chain of an audit log, and returns the number
+// of records read. With requireChain, every record must be chained, so that
+// stripping the hashes from a log does not turn it into a valid unchained
+// one. Otherwise, logs written without chaining verify only if they contain
+// no hashes at all.
+func VerifyAuditLog(r io.Reader, requireChain bool) (int, error) {
+	var (
+		n    int
+		last string
+	)
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, maxAuditLine)
+	for s.Scan() {
+		n++
+		var rec AuditRecord
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			return n, fmt.Errorf("record %d: %v", n, err)
+		}
+		if requireChain && rec.Hash == "" {
+			return n, fmt.Errorf("%w at record %d: record is not chained", ErrAuditChain, n)
+		}
+		if rec.PrevHash != last {
+			return n, fmt.Errorf("%w at record %d: previous hash %q, want %q", ErrAuditChain, n, rec.PrevHash, last)
+		}
+		if rec.Hash != "" || last != "" {
+			h, err := rec.hash()
+			if err != nil {
+				return n, err
+			}
+			if h != rec.Hash {
+				return n, fmt.Errorf("%w at record %d: hash %q, want %q", ErrAuditChain, n, rec.Hash, h)
+			}
+		}
+		last = rec.Hash
+	}
+	return n, s.Err()
+}
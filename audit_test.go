@@ -0,0 +1,119 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "audit.log")
+
+	write := func(results ...string) {
+		t.Helper()
+		a, err := OpenAuditLog(fileName, true)
+		if err != nil {
+			t.Fatalf("OpenAuditLog(): %v", err)
+		}
+		defer a.Close()
+		for _, res := range results {
+			rec := &AuditRecord{Time: time.Now().UTC(), Method: "GET", Path: "/", Result: res, Latency: 0.0123}
+			if err := a.Write(rec); err != nil {
+				t.Fatalf("Write(): %v", err)
+			}
+			if rec.Hash == "" {
+				t.Errorf("Write(): hash not set")
+			}
+		}
+	}
+	// Reopening must continue the chain.
+	write("served", "forbidden")
+	write("not_modified")
+
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("cannot read audit log: %v", err)
+	}
+	if n, err := VerifyAuditLog(bytes.NewReader(data), true); err != nil || n != 3 {
+		t.Errorf("VerifyAuditLog(): want 3 records, got: %d (err: %v)", n, err)
+	}
+
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	var tests = []struct {
+		name string
+		data []byte
+	}{
+		{name: "altered", data: bytes.Replace(data, []byte(`"forbidden"`), []byte(`"served"`), 1)},
+		{name: "removed", data: bytes.Join([][]byte{lines[0], lines[2]}, nil)},
+		{name: "reordered", data: bytes.Join([][]byte{lines[1], lines[0], lines[2]}, nil)},
+		{name: "stripped", data: stripHashes.ReplaceAll(bytes.Replace(data, []byte(`"forbidden"`), []byte(`"served"`), 1), nil)},
+	}
+	for _, tc := range tests {
+		if _, err := VerifyAuditLog(bytes.NewReader(tc.data), true); !errors.Is(err, ErrAuditChain) {
+			t.Errorf("[%s] VerifyAuditLog(): want ErrAuditChain, got: %v", tc.name, err)
+		}
+	}
+}
+
+// stripHashes removes the chain fields from JSON audit records.
+var stripHashes = regexp.MustCompile(`,?"(prev_hash|hash)":"[0-9a-f]*"`)
+
+func TestAuditLogUnchained(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "audit.log")
+	a, err := OpenAuditLog(fileName, false)
+	if err != nil {
+		t.Fatalf("OpenAuditLog(): %v", err)
+	}
+	for i := range 2 {
+		rec := &AuditRecord{Path: fmt.Sprintf("/%d", i), Result: "served"}
+		if err := a.Write(rec); err != nil || rec.Hash != "" {
+			t.Errorf("Write(): want no hash, got: %q (err: %v)", rec.Hash, err)
+		}
+	}
+	a.Close()
+	data, _ := os.ReadFile(fileName)
+	if n, err := VerifyAuditLog(bytes.NewReader(data), false); err != nil || n != 2 {
+		t.Errorf("VerifyAuditLog(): want 2 records, got: %d (err: %v)", n, err)
+	}
+	if _, err := VerifyAuditLog(bytes.NewReader(data), true); !errors.Is(err, ErrAuditChain) {
+		t.Errorf("VerifyAuditLog(require chain): want ErrAuditChain, got: %v", err)
+	}
+	// Chaining onto unchained records would never verify.
+	if a, err := OpenAuditLog(fileName, true); err == nil {
+		a.Close()
+		t.Errorf("OpenAuditLog(chain) of an unchained log: want error, got none")
+	}
+}
+
+func TestAuditRecordSetBundle(t *testing.T) {
+	_, leaf := newTestChain(t, "host.example.com")
+	data := append(append([]byte{}, leaf.certPEM...), leaf.keyPEM...)
+
+	var rec AuditRecord
+	rec.SetBundle("web", data)
+	wantFP, _ := BundleFingerprint(data)
+	if rec.Bundle != "web" || rec.BundleFingerprint != wantFP || rec.Serial != fmt.Sprintf("%x", leaf.cert.SerialNumber) {
+		t.Errorf("SetBundle(): got: %+v", rec)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// AnyClient is the mapping file key that matches every client identity.
+const AnyClient = "*"
+
+// ErrNoBundle is returned when a client identity has no bundle mapped to it.
+var ErrNoBundle = errors.New("no certificate bundle for client")
+
+// Bundle is a certificate and private key pair served to clients. If ACME
+// lists domains, the server obtains and renews the pair itself.
+type Bundle struct {
+	Name     string   `json:"-"`
+	CertFile string   `json:"cert"`
+	KeyFile  string   `json:"key"`
+	ACME     []string `json:"acme,omitempty"`
+}
+
+// Read returns the PEM data of the certificate followed by the private key.
+// Both files are read before anything is returned, so a failure never yields
+// half a bundle.
+func (b *Bundle) Read() ([]byte, error) {
+	cert, err := os.ReadFile(b.CertFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read certificate file for bundle %q: %v", b.Name, err)
+	}
+	key, err := os.ReadFile(b.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read key file for bundle %q: %v", b.Name, err)
+	}
+	return append(cert, key...), nil
+}
+
+// BundleStore maps client identities to the bundles they are allowed to fetch,
+// and optionally to public key files that served private keys are wrapped for.
+type BundleStore struct {
+	Bundles    map[string]*Bundle  `json:"bundles"`
+	Clients    map[string][]string `json:"clients"`
+	Recipients map[string]string   `json:"recipients,omitempty"`
+}
+
+// NewBundleStore returns a store that serves the configured certificate and key
+// to every client. It preserves the behaviour of servers without a mapping file.
+func NewBundleStore(cfg *Config) *BundleStore {
+	return &BundleStore{
+		Bundles: map[string]*Bundle{
+			"default": {Name: "default", CertFile: cfg.CertFile, KeyFile: cfg.CertKeyFile, ACME: cfg.ACMEDomains},
+		},
+		Clients: map[string][]string{
+			AnyClient: {"default"},
+		},
+	}
+}
+
+// LoadBundleStore reads a JSON mapping file of the form:
+//
+//	{
+//	  "bundles": {
+//	    "web": {"cert": "web.pem", "key": "web.key"},
+//	    "api": {"cert": "api.pem", "key": "api.key", "acme": ["api.example.com"]}
+//	  },
+//	  "clients": {"host.example.com": ["web", "api"], "*": ["web"]},
+//	  "recipients": {"host.example.com": "host-wrap.pub"}
+//	}
+func LoadBundleStore(fileName string) (*BundleStore, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read bundle mapping file %q: %v", fileName, err)
+	}
+	s := &BundleStore{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("cannot parse bundle mapping file %q: %v", fileName, err)
+	}
+	for name, b := range s.Bundles {
+		if b == nil || b.CertFile == "" || b.KeyFile == "" {
+			return nil, fmt.Errorf("bundle %q must specify both cert and key", name)
+		}
+		b.Name = name
+	}
+	clients := make(map[string][]string, len(s.Clients))
+	for client, names := range s.Clients {
+		for _, name := range names {
+			if _, ok := s.Bundles[name]; !ok {
+				return nil, fmt.Errorf("client %q is mapped to unknown bundle %q", client, name)
+			}
+		}
+		clients[normalizeIdentity(client)] = names
+	}
+	s.Clients = clients
+	recipients := make(map[string]string, len(s.Recipients))
+	for client, file := range s.Recipients {
+		recipients[normalizeIdentity(client)] = file
+	}
+	s.Recipients = recipients
+	return s, nil
+}
+
+// Recipient returns the public key registered for wrapping private keys served
+// to the client identity, or nil if there is none.
+func (s *BundleStore) Recipient(identity string) (crypto.PublicKey, error) {
+	file, ok := s.Recipients[normalizeIdentity(identity)]
+	if !ok {
+		return nil, nil
+	}
+	return ReadPublicKey(file)
+}
+
+// Lookup returns the bundles mapped to the client identity, most specific
+// first. ErrNoBundle is returned if there are none.
+func (s *BundleStore) Lookup(identity string) ([]*Bundle, error) {
+	names, ok := s.Clients[normalizeIdentity(identity)]
+	if !ok {
+		names, ok = s.Clients[AnyClient]
+	}
+	if !ok || len(names) == 0 {
+		return nil, fmt.Errorf("%w %q", ErrNoBundle, identity)
+	}
+	var bundles []*Bundle
+	for _, name := range names {
+		bundles = append(bundles, s.Bundles[name])
+	}
+	return bundles, nil
+}
+
+// Select returns the named bundle if it is mapped to the client identity. An
+// empty name selects the first mapped bundle.
+func (s *BundleStore) Select(identity, name string) (*Bundle, error) {
+	bundles, err := s.Lookup(identity)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return bundles[0], nil
+	}
+	for _, b := range bundles {
+		if b.Name == name {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("%w %q: %q", ErrNoBundle, identity, name)
+}
+
+func normalizeIdentity(s string) string {
+	return strings.ToLower(strings.TrimSuffix(s, "."))
+}
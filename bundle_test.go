@@ -0,0 +1,126 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadBundleStore(t *testing.T) {
+	dir := t.TempDir()
+	var tests = []struct {
+		data    string
+		wantErr bool
+	}{
+		{
+			data:    `{`,
+			wantErr: true,
+		},
+		{
+			data:    `{"bundles": {"web": {"cert": "c.pem"}}}`,
+			wantErr: true,
+		},
+		{
+			data:    `{"bundles": {"web": {"cert": "c.pem", "key": "k.pem"}}, "clients": {"host": ["mail"]}}`,
+			wantErr: true,
+		},
+		{
+			data:    `{"bundles": {"web": {"cert": "c.pem", "key": "k.pem"}}, "clients": {"host": ["web"]}}`,
+			wantErr: false,
+		},
+	}
+	for _, tc := range tests {
+		_, err := LoadBundleStore(writeFile(t, dir, "map.json", tc.data))
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("LoadBundleStore(%s): wantErr: %v, got: %v", tc.data, tc.wantErr, err)
+		}
+	}
+
+	if _, err := LoadBundleStore(filepath.Join(dir, "missing.json")); err == nil {
+		t.Errorf("LoadBundleStore(missing file): want error, got nil")
+	}
+}
+
+func TestBundleStoreSelect(t *testing.T) {
+	dir := t.TempDir()
+	s, err := LoadBundleStore(writeFile(t, dir, "map.json", `{
+		"bundles": {
+			"web":  {"cert": "web.pem", "key": "web.key"},
+			"mail": {"cert": "mail.pem", "key": "mail.key"},
+			"all":  {"cert": "all.pem", "key": "all.key"}
+		},
+		"clients": {
+			"Web.Example.com.":  ["web", "mail"],
+			"mail.example.com": ["mail"],
+			"none.example.com": []
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("LoadBundleStore(): %v", err)
+	}
+
+	var tests = []struct {
+		identity, name string
+		want           string
+		wantNoBundle   bool
+	}{
+		{identity: "web.example.com", want: "web"},
+		{identity: "WEB.example.com.", want: "web"},
+		{identity: "web.example.com", name: "mail", want: "mail"},
+		{identity: "web.example.com", name: "all", wantNoBundle: true},
+		{identity: "mail.example.com", want: "mail"},
+		{identity: "none.example.com", wantNoBundle: true},
+		{identity: "unknown.example.com", wantNoBundle: true},
+	}
+	for _, tc := range tests {
+		got, err := s.Select(tc.identity, tc.name)
+		if tc.wantNoBundle {
+			if !errors.Is(err, ErrNoBundle) {
+				t.Errorf("Select(%q, %q): want ErrNoBundle, got: %v", tc.identity, tc.name, err)
+			}
+			continue
+		}
+		if err != nil || got.Name != tc.want {
+			t.Errorf("Select(%q, %q): want: %q, got: %v (err: %v)", tc.identity, tc.name, tc.want, got, err)
+		}
+	}
+
+	// Wildcard mapping.
+	s.Clients[AnyClient] = []string{"all"}
+	if got, err := s.Select("unknown.example.com", ""); err != nil || got.Name != "all" {
+		t.Errorf("Select(%q) with wildcard: want: %q, got: %v (err: %v)", "unknown.example.com", "all", got, err)
+	}
+}
+
+func TestBundleRead(t *testing.T) {
+	dir := t.TempDir()
+	b := &Bundle{
+		Name:     "test",
+		CertFile: writeFile(t, dir, "cert.pem", "cert\n"),
+		KeyFile:  filepath.Join(dir, "missing.key"),
+	}
+	if data, err := b.Read(); err == nil {
+		t.Errorf("Read() with missing key: want error, got: %q", data)
+	}
+	b.KeyFile = writeFile(t, dir, "key.pem", "key\n")
+	data, err := b.Read()
+	if err != nil || string(data) != "cert\nkey\n" {
+		t.Errorf("Read(): want: %q, got: %q (err: %v)", "cert\nkey\n", data, err)
+	}
+}
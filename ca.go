@@ -0,0 +1,427 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Key types accepted by GenerateKey.
+const (
+	KeyECDSAP256 = "ecdsa-p256"
+	KeyECDSAP384 = "ecdsa-p384"
+	KeyEd25519   = "ed25519"
+	KeyRSA2048   = "rsa-2048"
+	KeyRSA4096   = "rsa-4096"
+
+	DefaultKeyType = KeyECDSAP256
+)
+
+// DefaultCRLLifetime is how long a CRL is valid for. The CRL must be written
+// again, with a revocation or with UpdateCRL, before it expires.
+const DefaultCRLLifetime = 30 * 24 * time.Hour
+
+// Files in a CA directory.
+const (
+	CACertFileName  = "ca.pem"
+	CAKeyFileName   = "ca.key"
+	CAIndexFileName = "index.json"
+	CACRLFileName   = "crl.pem"
+	caLockFileName  = "index.lock"
+
+	pemTypeCRL = "X509 CRL"
+)
+
+// ErrNotFound is returned when a CA index has no entry for a serial number.
+var ErrNotFound = errors.New("not found")
+
+// GenerateKey returns a new private key of the given type.
+func GenerateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case KeyECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyEd25519:
+		_, k, err := ed25519.GenerateKey(rand.Reader)
+		return k, err
+	case KeyRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	}
+	return nil, fmt.Errorf("unknown key type %q", keyType)
+}
+
+// EncodeKey returns the PKCS#8 PEM encoding of a private key.
+func EncodeKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal private key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: PEMTypePrivateKey, Bytes: der}), nil
+}
+
+// RandomSerial returns a random, positive 128-bit certificate serial number.
+func RandomSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate serial number: %v", err)
+	}
+	return serial.Add(serial, big.NewInt(1)), nil
+}
+
+// IndexEntry records a certificate issued by a CA.
+type IndexEntry struct {
+	Serial    string    `json:"serial"`
+	Subject   string    `json:"subject"`
+	DNSNames  []string  `json:"dns_names,omitempty"`
+	IPs       []string  `json:"ips,omitempty"`
+	URIs      []string  `json:"uris,omitempty"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	RevokedAt time.Time `json:"revoked_at,omitzero"`
+}
+
+// CA is a certificate authority kept in a directory.
+type CA struct {
+	Dir  string
+	Cert *x509.Certificate
+	Key  crypto.Signer
+
+	// mu serializes updates of the index within the process. Other processes
+	// are locked out with a lock file, see lockIndex.
+	mu sync.Mutex
+}
+
+// InitCA creates a new self-signed CA in dir, which must not already contain
+// one.
+func InitCA(dir string, subject pkix.Name, keyType string, lifetime time.Duration) (*CA, error) {
+	if _, err := os.Stat(filepath.Join(dir, CAKeyFileName)); err == nil {
+		return nil, fmt.Errorf("CA already exists in %q", dir)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("cannot create CA directory %q: %v", dir, err)
+	}
+	key, err := GenerateKey(keyType)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := RandomSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               subject,
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.Add(lifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse CA certificate: %v", err)
+	}
+	keyPEM, err := EncodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	index, err := json.Marshal([]IndexEntry{})
+	if err != nil {
+		return nil, err
+	}
+	ca := &CA{Dir: dir, Cert: cert, Key: key}
+	crl, err := ca.createCRL(nil, DefaultCRLLifetime)
+	if err != nil {
+		return nil, err
+	}
+	err = WriteAtomic(
+		AtomicFile{Name: filepath.Join(dir, CAKeyFileName), Data: keyPEM, Mode: 0600},
+		AtomicFile{Name: filepath.Join(dir, CACertFileName), Data: pem.EncodeToMemory(&pem.Block{Type: PEMTypeCertificate, Bytes: der}), Mode: 0644},
+		AtomicFile{Name: filepath.Join(dir, CAIndexFileName), Data: index, Mode: 0600},
+		AtomicFile{Name: filepath.Join(dir, CACRLFileName), Data: crl, Mode: 0644},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
+
+// LoadCA loads the CA kept in dir.
+func LoadCA(dir string) (*CA, error) {
+	cert, err := ReadCertificate(filepath.Join(dir, CACertFileName))
+	if err != nil {
+		return nil, err
+	}
+	key, err := ReadPrivateKey(filepath.Join(dir, CAKeyFileName))
+	if err != nil {
+		return nil, err
+	}
+	return &CA{Dir: dir, Cert: cert, Key: key}, nil
+}
+
+// CertPEM returns the PEM encoded CA certificate.
+func (ca *CA) CertPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: PEMTypeCertificate, Bytes: ca.Cert.Raw})
+}
+
+// IssueRequest describes a client certificate to be issued.
+type IssueRequest struct {
+	Subject  pkix.Name
+	DNSNames []string
+	IPs      []net.IP
+	URIs     []*url.URL
+	Lifetime time.Duration
+	// ExtKeyUsage defaults to clientAuth only.
+	ExtKeyUsage []x509.ExtKeyUsage
+}
+
+// Sign issues a certificate for pub and records it in the index.
+// It returns the PEM encoded certificate.
+func (ca *CA) Sign(req IssueRequest, pub crypto.PublicKey) ([]byte, error) {
+	serial, err := RandomSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	notAfter := now.Add(req.Lifetime)
+	if notAfter.After(ca.Cert.NotAfter) {
+		notAfter = ca.Cert.NotAfter
+	}
+	extKeyUsage := req.ExtKeyUsage
+	if len(extKeyUsage) == 0 {
+		extKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	keyUsage := x509.KeyUsageDigitalSignature
+	if _, isRSA := pub.(*rsa.PublicKey); isRSA {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      req.Subject,
+		DNSNames:     req.DNSNames,
+		IPAddresses:  req.IPs,
+		URIs:         req.URIs,
+		NotBefore:    now.Add(-5 * time.Minute),
+		NotAfter:     notAfter,
+		KeyUsage:     keyUsage,
+		ExtKeyUsage:  extKeyUsage,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Cert, pub, ca.Key)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse issued certificate: %v", err)
+	}
+
+	entry := IndexEntry{
+		Serial:    cert.SerialNumber.Text(16),
+		Subject:   cert.Subject.String(),
+		DNSNames:  cert.DNSNames,
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+	}
+	for _, ip := range cert.IPAddresses {
+		entry.IPs = append(entry.IPs, ip.String())
+	}
+	for _, u := range cert.URIs {
+		entry.URIs = append(entry.URIs, u.String())
+	}
+	unlock, err := ca.lockIndex()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	index, err := ca.Index()
+	if err != nil {
+		return nil, err
+	}
+	if err := ca.writeIndex(append(index, entry)); err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: PEMTypeCertificate, Bytes: der}), nil
+}
+
+// Issue generates a key of keyType and issues a certificate for it. It returns
+// the PEM encoded certificate and key.
+func (ca *CA) Issue(req IssueRequest, keyType string) (certPEM, keyPEM []byte, err error) {
+	key, err := GenerateKey(keyType)
+	if err != nil {
+		return nil, nil, err
+	}
+	if keyPEM, err = EncodeKey(key); err != nil {
+		return nil, nil, err
+	}
+	if certPEM, err = ca.Sign(req, key.Public()); err != nil {
+		return nil, nil, err
+	}
+	return certPEM, keyPEM, nil
+}
+
+// Index returns all certificates issued by the CA.
+func (ca *CA) Index() ([]IndexEntry, error) {
+	fileName := filepath.Join(ca.Dir, CAIndexFileName)
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CA index %q: %v", fileName, err)
+	}
+	var index []IndexEntry
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("cannot parse CA index %q: %v", fileName, err)
+	}
+	return index, nil
+}
+
+// lockIndex locks the index for an update, against other goroutines and
+// against other processes, such as certsync_ca and a server signing CSRs with
+// the same CA. It returns the function that unlocks it.
+func (ca *CA) lockIndex() (func(), error) {
+	ca.mu.Lock()
+	unlock, err := lockFile(filepath.Join(ca.Dir, caLockFileName))
+	if err != nil {
+		ca.mu.Unlock()
+		return nil, err
+	}
+	return func() {
+		unlock()
+		ca.mu.Unlock()
+	}, nil
+}
+
+func (ca *CA) writeIndex(index []IndexEntry) error {
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteAtomic(AtomicFile{Name: filepath.Join(ca.Dir, CAIndexFileName), Data: data, Mode: 0600})
+}
+
+// Revoke marks the certificate with the given hex serial number as revoked
+// and writes a new CRL, valid for crlLifetime.
+func (ca *CA) Revoke(serial string, crlLifetime time.Duration) error {
+	unlock, err := ca.lockIndex()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	index, err := ca.Index()
+	if err != nil {
+		return err
+	}
+	want, ok := new(big.Int).SetString(serial, 16)
+	if !ok {
+		return fmt.Errorf("invalid serial number %q", serial)
+	}
+	found := false
+	for i := range index {
+		s, _ := new(big.Int).SetString(index[i].Serial, 16)
+		if s == nil || s.Cmp(want) != 0 {
+			continue
+		}
+		if !index[i].RevokedAt.IsZero() {
+			return fmt.Errorf("certificate %s already revoked at %v", serial, index[i].RevokedAt)
+		}
+		index[i].RevokedAt = time.Now().UTC()
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("certificate %s: %w", serial, ErrNotFound)
+	}
+
+	crl, err := ca.createCRL(index, crlLifetime)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteAtomic(
+		AtomicFile{Name: filepath.Join(ca.Dir, CAIndexFileName), Data: data, Mode: 0600},
+		AtomicFile{Name: filepath.Join(ca.Dir, CACRLFileName), Data: crl, Mode: 0644},
+	)
+}
+
+// UpdateCRL writes a new CRL, valid for lifetime, with the certificates
+// revoked so far. It must be run before the current CRL expires, e.g. from
+// cron, as the CRL is otherwise only written on a revocation.
+func (ca *CA) UpdateCRL(lifetime time.Duration) error {
+	unlock, err := ca.lockIndex()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	index, err := ca.Index()
+	if err != nil {
+		return err
+	}
+	crl, err := ca.createCRL(index, lifetime)
+	if err != nil {
+		return err
+	}
+	return WriteAtomic(AtomicFile{Name: filepath.Join(ca.Dir, CACRLFileName), Data: crl, Mode: 0644})
+}
+
+func (ca *CA) createCRL(index []IndexEntry, lifetime time.Duration) ([]byte, error) {
+	var revoked []x509.RevocationListEntry
+	for _, e := range index {
+		if e.RevokedAt.IsZero() {
+			continue
+		}
+		s, _ := new(big.Int).SetString(e.Serial, 16)
+		revoked = append(revoked, x509.RevocationListEntry{SerialNumber: s, RevocationTime: e.RevokedAt})
+	}
+	now := time.Now()
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(now.UnixNano()),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(lifetime),
+		RevokedCertificateEntries: revoked,
+	}, ca.Cert, ca.Key)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create CRL: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: pemTypeCRL, Bytes: der}), nil
+}
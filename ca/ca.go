@@ -0,0 +1,290 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"crypto/x509/pkix"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	cs "github.com/icemarkom/certsync"
+	"github.com/icemarkom/certsync/common"
+)
+
+const (
+	defaultCADir          = "/etc/certsync/ca"
+	defaultCALifetime     = 10 * 365 * 24 * time.Hour
+	defaultClientLifetime = 365 * 24 * time.Hour
+)
+
+var (
+	cfg *cs.Config
+
+	binaryName, version, gitCommit string
+)
+
+type command struct {
+	name, args, help string
+	run              func([]string) error
+}
+
+var commands = []command{
+	{"init", "", "Create a new CA.", runInit},
+	{"issue", "<fqdn>", "Issue a machine (clientAuth) certificate and key.", runIssue},
+	{"list", "", "List issued certificates.", runList},
+	{"revoke", "<serial>", "Revoke a certificate and write a new CRL.", runRevoke},
+	{"crl", "", "Write a new CRL. Run it before the current CRL expires.", runCRL},
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage of %s:\n", cfg.BinaryName)
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %s %s [flags] %s\n    \t%s\n", cfg.BinaryName, c.name, c.args, c.help)
+	}
+	fmt.Fprintf(out, "\nRun %q for the flags of a command.\n\n", cfg.BinaryName+" <command> -help")
+	common.ProgramVersion(cfg)
+}
+
+func newFlagSet(name string, dir *string) *flag.FlagSet {
+	fs := flag.NewFlagSet(cfg.BinaryName+" "+name, flag.ExitOnError)
+	fs.StringVar(dir, "dir", defaultCADir, "CA directory")
+	common.FlagSetLogFlags(fs, cfg)
+	return fs
+}
+
+// parseFlags parses the flags of a command and sets up logging.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	fs.Parse(args)
+	return common.SetupLogging(cfg)
+}
+
+func runInit(args []string) error {
+	var (
+		dir, name, org, keyType string
+		lifetime                time.Duration
+	)
+	fs := newFlagSet("init", &dir)
+	fs.StringVar(&name, "name", "CertSync CA", "CA common name")
+	fs.StringVar(&org, "org", "", "CA organization")
+	fs.StringVar(&keyType, "key", cs.DefaultKeyType, "Key type: ecdsa-p256, ecdsa-p384, ed25519, rsa-2048 or rsa-4096")
+	fs.DurationVar(&lifetime, "lifetime", defaultCALifetime, "CA certificate lifetime")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	subject := pkix.Name{CommonName: name}
+	if org != "" {
+		subject.Organization = []string{org}
+	}
+	ca, err := cs.InitCA(dir, subject, keyType, lifetime)
+	if err != nil {
+		return err
+	}
+	slog.Info("CA created", "subject", ca.Cert.Subject.String(), "dir", dir, "not_after", ca.Cert.NotAfter)
+	return nil
+}
+
+func runIssue(args []string) error {
+	var (
+		dir, org, keyType, outDir string
+		extraDNS, ips, uris       []string
+		lifetime                  time.Duration
+		skipDNS                   bool
+	)
+	fs := newFlagSet("issue", &dir)
+	fs.StringVar(&org, "org", "", "Certificate organization")
+	fs.StringVar(&keyType, "key", cs.DefaultKeyType, "Key type: ecdsa-p256, ecdsa-p384, ed25519, rsa-2048 or rsa-4096")
+	fs.DurationVar(&lifetime, "lifetime", defaultClientLifetime, "Certificate lifetime")
+	fs.StringVar(&outDir, "out", ".", "Directory to write <fqdn>.pem and <fqdn>.key to")
+	common.FlagSetStringsVar(fs, &extraDNS, "dns", "Additional DNS SAN. May be repeated.")
+	common.FlagSetStringsVar(fs, &ips, "ip", "IP address SAN. May be repeated.")
+	common.FlagSetStringsVar(fs, &uris, "uri", "URI SAN, e.g. a SPIFFE ID. May be repeated.")
+	fs.BoolVar(&skipDNS, "skip_dns", false, "Do not require the machine to be in DNS")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("must specify exactly one machine FQDN")
+	}
+	fqdn := fs.Arg(0)
+	if !skipDNS {
+		if err := cs.CheckHostName(cfg, fqdn); err != nil {
+			return err
+		}
+	}
+
+	req := cs.IssueRequest{
+		Subject:  pkix.Name{CommonName: fqdn},
+		DNSNames: append([]string{fqdn}, extraDNS...),
+		Lifetime: lifetime,
+	}
+	if org != "" {
+		req.Subject.Organization = []string{org}
+	}
+	for _, s := range ips {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return fmt.Errorf("invalid IP address %q", s)
+		}
+		req.IPs = append(req.IPs, ip)
+	}
+	for _, s := range uris {
+		u, err := url.Parse(s)
+		if err != nil {
+			return fmt.Errorf("invalid URI %q: %v", s, err)
+		}
+		req.URIs = append(req.URIs, u)
+	}
+
+	ca, err := cs.LoadCA(dir)
+	if err != nil {
+		return err
+	}
+	certPEM, keyPEM, err := ca.Issue(req, keyType)
+	if err != nil {
+		return err
+	}
+	certFile, keyFile := filepath.Join(outDir, fqdn+".pem"), filepath.Join(outDir, fqdn+".key")
+	err = cs.WriteAtomic(
+		cs.AtomicFile{Name: certFile, Data: certPEM, Mode: 0644},
+		cs.AtomicFile{Name: keyFile, Data: keyPEM, Mode: 0600},
+	)
+	if err != nil {
+		return err
+	}
+	slog.Info("Certificate issued", cs.LogKeyHost, fqdn, "cert_file", certFile, "key_file", keyFile)
+	return nil
+}
+
+func runList(args []string) error {
+	var dir string
+	fs := newFlagSet("list", &dir)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	ca, err := cs.LoadCA(dir)
+	if err != nil {
+		return err
+	}
+	index, err := ca.Index()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SERIAL\tSUBJECT\tNOT AFTER\tSTATUS")
+	for _, e := range index {
+		status := "valid"
+		switch {
+		case !e.RevokedAt.IsZero():
+			status = "revoked " + e.RevokedAt.Format(time.RFC3339)
+		case now.After(e.NotAfter):
+			status = "expired"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", e.Serial, e.Subject, e.NotAfter.Format(time.RFC3339), status)
+	}
+	return w.Flush()
+}
+
+func crlLifetimeVar(fs *flag.FlagSet, lifetime *time.Duration) {
+	fs.DurationVar(lifetime, "crl_lifetime", cs.DefaultCRLLifetime, "How long the written CRL is valid for")
+}
+
+func runRevoke(args []string) error {
+	var (
+		dir         string
+		crlLifetime time.Duration
+	)
+	fs := newFlagSet("revoke", &dir)
+	crlLifetimeVar(fs, &crlLifetime)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("must specify exactly one serial number")
+	}
+	ca, err := cs.LoadCA(dir)
+	if err != nil {
+		return err
+	}
+	if err := ca.Revoke(fs.Arg(0), crlLifetime); err != nil {
+		return err
+	}
+	slog.Info("Certificate revoked", "serial", fs.Arg(0), cs.LogKeyFile, filepath.Join(dir, cs.CACRLFileName))
+	return nil
+}
+
+func runCRL(args []string) error {
+	var (
+		dir      string
+		lifetime time.Duration
+	)
+	fs := newFlagSet("crl", &dir)
+	crlLifetimeVar(fs, &lifetime)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	ca, err := cs.LoadCA(dir)
+	if err != nil {
+		return err
+	}
+	if err := ca.UpdateCRL(lifetime); err != nil {
+		return err
+	}
+	slog.Info("CRL written", cs.LogKeyFile, filepath.Join(dir, cs.CACRLFileName), "next_update", time.Now().Add(lifetime).Round(time.Second))
+	return nil
+}
+
+func main() {
+	cfg = cs.NewConfig(binaryName, version, gitCommit)
+	flag.Usage = usage
+
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(0)
+	}
+	switch os.Args[1] {
+	case "-version", "--version", "version":
+		common.ProgramVersion(cfg)
+		os.Exit(0)
+	case "-help", "--help", "-h", "help":
+		usage()
+		os.Exit(0)
+	}
+	for _, c := range commands {
+		if c.name != os.Args[1] {
+			continue
+		}
+		if err := c.run(os.Args[2:]); err != nil {
+			common.Fatal("Command failed", "command", c.name, cs.ErrAttr(err))
+		}
+		return
+	}
+	common.Fatal("Unknown command", "command", os.Args[1], "help", cfg.BinaryName+" -help")
+}
@@ -0,0 +1,167 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGenerateKey(t *testing.T) {
+	for _, kt := range []string{KeyECDSAP256, KeyECDSAP384, KeyEd25519, KeyRSA2048} {
+		k, err := GenerateKey(kt)
+		if err != nil {
+			t.Errorf("GenerateKey(%q): %v", kt, err)
+			continue
+		}
+		if _, err := EncodeKey(k); err != nil {
+			t.Errorf("EncodeKey(%q): %v", kt, err)
+		}
+	}
+	if _, err := GenerateKey("dsa"); err == nil {
+		t.Errorf("GenerateKey(%q): want error, got nil", "dsa")
+	}
+}
+
+func TestCA(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "ca")
+	if _, err := InitCA(dir, pkix.Name{CommonName: "Test CA"}, KeyEd25519, 24*time.Hour); err != nil {
+		t.Fatalf("InitCA(): %v", err)
+	}
+	if _, err := InitCA(dir, pkix.Name{CommonName: "Test CA"}, KeyEd25519, 24*time.Hour); err == nil {
+		t.Errorf("InitCA(existing): want error, got nil")
+	}
+	if fi, err := os.Stat(filepath.Join(dir, CAKeyFileName)); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("InitCA(): CA key must be mode 0600, got: %v (err: %v)", fi.Mode().Perm(), err)
+	}
+
+	ca, err := LoadCA(dir)
+	if err != nil {
+		t.Fatalf("LoadCA(): %v", err)
+	}
+	certPEM, keyPEM, err := ca.Issue(IssueRequest{
+		Subject:  pkix.Name{CommonName: "host.example.com"},
+		DNSNames: []string{"host.example.com"},
+		IPs:      []net.IP{net.ParseIP("10.0.0.1")},
+		Lifetime: 48 * time.Hour,
+	}, KeyECDSAP256)
+	if err != nil {
+		t.Fatalf("Issue(): %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	leaf, err := VerifyBundle(certPEM, keyPEM, VerifyOptions{Roots: roots, DNSName: "host.example.com"})
+	if err != nil {
+		t.Fatalf("VerifyBundle(issued): %v", err)
+	}
+	if leaf.NotAfter.After(ca.Cert.NotAfter) {
+		t.Errorf("Issue(): certificate outlives the CA: %v > %v", leaf.NotAfter, ca.Cert.NotAfter)
+	}
+	if len(leaf.ExtKeyUsage) != 1 || leaf.ExtKeyUsage[0] != x509.ExtKeyUsageClientAuth {
+		t.Errorf("Issue(): want clientAuth only, got: %v", leaf.ExtKeyUsage)
+	}
+
+	// A second certificate must get a different serial.
+	if _, _, err := ca.Issue(IssueRequest{Subject: pkix.Name{CommonName: "other.example.com"}, Lifetime: time.Hour}, KeyEd25519); err != nil {
+		t.Fatalf("Issue(): %v", err)
+	}
+	index, err := ca.Index()
+	if err != nil || len(index) != 2 || index[0].Serial == index[1].Serial {
+		t.Fatalf("Index(): want 2 entries with distinct serials, got: %+v (err: %v)", index, err)
+	}
+	if index[0].Serial != leaf.SerialNumber.Text(16) || index[0].IPs[0] != "10.0.0.1" {
+		t.Errorf("Index(): want entry for issued certificate, got: %+v", index[0])
+	}
+
+	if err := ca.Revoke(index[0].Serial, time.Hour); err != nil {
+		t.Fatalf("Revoke(): %v", err)
+	}
+	if err := ca.Revoke(index[0].Serial, time.Hour); err == nil {
+		t.Errorf("Revoke(already revoked): want error, got nil")
+	}
+	if err := ca.Revoke("abcdef", time.Hour); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Revoke(unknown): want ErrNotFound, got: %v", err)
+	}
+	if index, _ := ca.Index(); index[0].RevokedAt.IsZero() || !index[1].RevokedAt.IsZero() {
+		t.Errorf("Revoke(): want only the first entry revoked, got: %+v", index)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, CACRLFileName))
+	if err != nil {
+		t.Fatalf("cannot read CRL: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if err != nil {
+		t.Fatalf("cannot parse CRL: %v", err)
+	}
+	if err := crl.CheckSignatureFrom(ca.Cert); err != nil {
+		t.Errorf("CRL signature: %v", err)
+	}
+	if len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+		t.Errorf("CRL: want only the revoked certificate, got: %+v", crl.RevokedCertificateEntries)
+	}
+
+	if err := ca.UpdateCRL(48 * time.Hour); err != nil {
+		t.Fatalf("UpdateCRL(): %v", err)
+	}
+	updated, err := loadCRL(filepath.Join(dir, CACRLFileName), ca.CertPEM())
+	if err != nil {
+		t.Fatalf("loadCRL(): %v", err)
+	}
+	if !updated.NextUpdate.After(crl.NextUpdate) || len(updated.RevokedCertificateEntries) != 1 {
+		t.Errorf("UpdateCRL(): want a later next update with the same revocations, got: %v, %+v", updated.NextUpdate, updated.RevokedCertificateEntries)
+	}
+}
+
+func TestCAConcurrentIssue(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "ca")
+	if _, err := InitCA(dir, pkix.Name{CommonName: "Test CA"}, KeyEd25519, 24*time.Hour); err != nil {
+		t.Fatalf("InitCA(): %v", err)
+	}
+	// Separately loaded CAs, like certsync_ca and a server, share only the
+	// lock file.
+	const n = 10
+	var wg sync.WaitGroup
+	for range n {
+		ca, err := LoadCA(dir)
+		if err != nil {
+			t.Fatalf("LoadCA(): %v", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := ca.Issue(IssueRequest{Subject: pkix.Name{CommonName: "host.example.com"}, Lifetime: time.Hour}, KeyEd25519); err != nil {
+				t.Errorf("Issue(): %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	ca, _ := LoadCA(dir)
+	if index, err := ca.Index(); err != nil || len(index) != n {
+		t.Errorf("Index(): want %d entries, got %d (err: %v)", n, len(index), err)
+	}
+}
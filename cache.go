@@ -0,0 +1,205 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Defaults of the DNS cache.
+const (
+	DefaultDNSCacheTTL    = 300
+	DefaultDNSNegativeTTL = 60
+)
+
+// CachingResolver caches the answers of another Resolver. Concurrent lookups
+// of the same name share a single upstream query.
+//
+// If the upstream is a TTLResolver, answers are cached for their TTL, capped
+// at the TTL given to NewCachingResolver, and "not found" for its negative
+// TTL, capped at the negative TTL given. Otherwise those TTLs are used as they
+// are. Other errors are not cached. At most size names are kept, least
+// recently used first out. Upstream queries, which are shared and so not
+// canceled with the caller that started them, give up after the timeout given
+// to NewCachingResolver, unless it is zero.
+//
+// A CachingResolver must be created with NewCachingResolver.
+type CachingResolver struct {
+	upstream               Resolver
+	size                   int
+	maxTTL, maxNegativeTTL time.Duration
+	timeout                time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List
+	group   singleflight.Group
+	now     func() time.Time
+}
+
+type cacheEntry struct {
+	key     string
+	addrs   []net.IPAddr
+	names   []string
+	err     error
+	expires time.Time
+}
+
+// NewCachingResolver returns a CachingResolver for upstream.
+func NewCachingResolver(upstream Resolver, size int, ttl, negativeTTL, timeout time.Duration) *CachingResolver {
+	return &CachingResolver{
+		upstream:       upstream,
+		size:           size,
+		maxTTL:         ttl,
+		maxNegativeTTL: negativeTTL,
+		timeout:        timeout,
+		entries:        make(map[string]*list.Element),
+		now:            time.Now,
+	}
+}
+
+// Upstream returns the resolver whose answers c caches.
+func (c *CachingResolver) Upstream() Resolver {
+	return c.upstream
+}
+
+func (c *CachingResolver) get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if !c.now().Before(e.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return e, true
+}
+
+func (c *CachingResolver) put(e *cacheEntry, ttl time.Duration) {
+	if ttl <= 0 || c.size <= 0 {
+		return
+	}
+	e.expires = c.now().Add(ttl)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.key]; ok {
+		c.lru.Remove(el)
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.size {
+		old := c.lru.Back()
+		c.lru.Remove(old)
+		delete(c.entries, old.Value.(*cacheEntry).key)
+	}
+}
+
+// ttl returns how long to cache an answer with the upstream TTL reported, if
+// any.
+func (c *CachingResolver) ttl(upstream time.Duration, reported bool, err error) time.Duration {
+	limit := c.maxTTL
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return 0
+		}
+		limit = c.maxNegativeTTL
+	}
+	if !reported {
+		return limit
+	}
+	return min(upstream, limit)
+}
+
+// lookup returns the cached entry for key, or resolves it with fn. Callers
+// waiting for a shared lookup give up when their ctx is done, without
+// canceling the lookup for others, which is bounded by c.timeout instead.
+func (c *CachingResolver) lookup(ctx context.Context, key string, fn func(context.Context) (*cacheEntry, time.Duration)) (*cacheEntry, error) {
+	if e, ok := c.get(key); ok {
+		return e, nil
+	}
+	ch := c.group.DoChan(key, func() (any, error) {
+		qctx, cancel := context.WithoutCancel(ctx), context.CancelFunc(func() {})
+		if c.timeout > 0 {
+			qctx, cancel = context.WithTimeout(qctx, c.timeout)
+		}
+		defer cancel()
+		e, ttl := fn(qctx)
+		e.key = key
+		c.put(e, ttl)
+		return e, nil
+	})
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-ch:
+		return res.Val.(*cacheEntry), nil
+	}
+}
+
+// LookupIPAddr implements Resolver.
+func (c *CachingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	e, err := c.lookup(ctx, "ip:"+strings.ToLower(strings.TrimSuffix(host, ".")), func(ctx context.Context) (*cacheEntry, time.Duration) {
+		var e cacheEntry
+		if tr, ok := c.upstream.(TTLResolver); ok {
+			addrs, ttl, err := tr.LookupIPAddrTTL(ctx, host)
+			e.addrs, e.err = addrs, err
+			return &e, c.ttl(ttl, true, err)
+		}
+		e.addrs, e.err = c.upstream.LookupIPAddr(ctx, host)
+		return &e, c.ttl(0, false, e.err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e.addrs, e.err
+}
+
+// LookupAddr implements Resolver.
+func (c *CachingResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	e, err := c.lookup(ctx, "ptr:"+addr, func(ctx context.Context) (*cacheEntry, time.Duration) {
+		var e cacheEntry
+		if tr, ok := c.upstream.(TTLResolver); ok {
+			names, ttl, err := tr.LookupAddrTTL(ctx, addr)
+			e.names, e.err = names, err
+			return &e, c.ttl(ttl, true, err)
+		}
+		e.names, e.err = c.upstream.LookupAddr(ctx, addr)
+		return &e, c.ttl(0, false, e.err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e.names, e.err
+}
+
+// LookupHost implements Resolver, from the LookupIPAddr cache.
+func (c *CachingResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return ipAddrStrings(c.LookupIPAddr(ctx, host))
+}
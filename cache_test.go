@@ -0,0 +1,252 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/go-mockdns"
+)
+
+// countingResolver counts upstream lookups, and can hold them until release
+// is closed.
+type countingResolver struct {
+	Resolver
+	mu      sync.Mutex
+	calls   map[string]int
+	release chan struct{}
+}
+
+func newCountingResolver(r Resolver) *countingResolver {
+	return &countingResolver{Resolver: r, calls: make(map[string]int)}
+}
+
+func (c *countingResolver) count(key string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls[key]
+}
+
+func (c *countingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	c.mu.Lock()
+	c.calls[host]++
+	c.mu.Unlock()
+	if c.release != nil {
+		<-c.release
+	}
+	return c.Resolver.LookupIPAddr(ctx, host)
+}
+
+func (c *countingResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	c.mu.Lock()
+	c.calls[addr]++
+	c.mu.Unlock()
+	return c.Resolver.LookupAddr(ctx, addr)
+}
+
+// ttlResolver reports a fixed TTL for every answer.
+type ttlResolver struct {
+	*countingResolver
+	ttl time.Duration
+}
+
+func (t ttlResolver) LookupIPAddrTTL(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	addrs, err := t.LookupIPAddr(ctx, host)
+	return addrs, t.ttl, err
+}
+
+func (t ttlResolver) LookupAddrTTL(ctx context.Context, addr string) ([]string, time.Duration, error) {
+	names, err := t.LookupAddr(ctx, addr)
+	return names, t.ttl, err
+}
+
+type fakeClock struct{ t time.Time }
+
+func (f *fakeClock) now() time.Time          { return f.t }
+func (f *fakeClock) advance(d time.Duration) { f.t = f.t.Add(d) }
+
+func newTestCache(upstream Resolver, size int) (*CachingResolver, *fakeClock) {
+	clock := &fakeClock{t: time.Now()}
+	c := NewCachingResolver(upstream, size, 5*time.Minute, time.Minute, time.Minute)
+	c.now = clock.now
+	return c, clock
+}
+
+func TestCachingResolver(t *testing.T) {
+	ctx := context.Background()
+	upstream := newCountingResolver(setUp().Resolver)
+	c, clock := newTestCache(upstream, 10)
+
+	for range 3 {
+		if addrs, err := c.LookupIPAddr(ctx, "valid.example.com"); err != nil || len(addrs) != 2 {
+			t.Fatalf("LookupIPAddr(): want 2 addresses, got: %v (err: %v)", addrs, err)
+		}
+		if names, err := c.LookupAddr(ctx, "10.0.0.1"); err != nil || len(names) != 1 {
+			t.Fatalf("LookupAddr(): want 1 name, got: %v (err: %v)", names, err)
+		}
+		if _, err := c.LookupIPAddr(ctx, "invalid.example.com"); err == nil {
+			t.Fatalf("LookupIPAddr(invalid): want error, got nil")
+		}
+	}
+	for _, key := range []string{"valid.example.com", "10.0.0.1", "invalid.example.com"} {
+		if got := upstream.count(key); got != 1 {
+			t.Errorf("upstream lookups of %q: want 1, got: %d", key, got)
+		}
+	}
+
+	// Negative answers expire first.
+	clock.advance(2 * time.Minute)
+	c.LookupIPAddr(ctx, "valid.example.com")
+	c.LookupIPAddr(ctx, "invalid.example.com")
+	if got := upstream.count("valid.example.com"); got != 1 {
+		t.Errorf("upstream lookups of cached name: want 1, got: %d", got)
+	}
+	if got := upstream.count("invalid.example.com"); got != 2 {
+		t.Errorf("upstream lookups of expired negative answer: want 2, got: %d", got)
+	}
+	clock.advance(5 * time.Minute)
+	if addrs, err := c.LookupHost(ctx, "valid.example.com"); err != nil || len(addrs) != 2 {
+		t.Errorf("LookupHost(): want 2 addresses, got: %v (err: %v)", addrs, err)
+	}
+	if got := upstream.count("valid.example.com"); got != 2 {
+		t.Errorf("upstream lookups of expired answer: want 2, got: %d", got)
+	}
+}
+
+func TestCachingResolverErrors(t *testing.T) {
+	upstream := newCountingResolver(&mockdns.Resolver{
+		Zones: map[string]mockdns.Zone{
+			"broken.example.com.": {Err: errors.New("server failure")},
+		},
+	})
+	c, _ := newTestCache(upstream, 10)
+	for range 2 {
+		if _, err := c.LookupIPAddr(context.Background(), "broken.example.com"); err == nil {
+			t.Fatalf("LookupIPAddr(): want error, got nil")
+		}
+	}
+	if got := upstream.count("broken.example.com"); got != 2 {
+		t.Errorf("upstream lookups after failure: want 2 (failures not cached), got: %d", got)
+	}
+}
+
+func TestCachingResolverTTL(t *testing.T) {
+	var tests = []struct {
+		ttl     time.Duration
+		advance time.Duration
+		want    int
+	}{
+		{ttl: 10 * time.Second, advance: 9 * time.Second, want: 1},
+		{ttl: 10 * time.Second, advance: 10 * time.Second, want: 2},
+		// Capped at the TTL of the cache.
+		{ttl: time.Hour, advance: 5 * time.Minute, want: 2},
+		{ttl: 0, advance: 0, want: 2},
+	}
+
+	for _, tc := range tests {
+		upstream := ttlResolver{newCountingResolver(setUp().Resolver), tc.ttl}
+		c, clock := newTestCache(upstream, 10)
+		c.LookupIPAddr(context.Background(), "valid.example.com")
+		clock.advance(tc.advance)
+		c.LookupIPAddr(context.Background(), "valid.example.com")
+		if got := upstream.count("valid.example.com"); got != tc.want {
+			t.Errorf("[TTL %v, after %v] upstream lookups: want: %d, got: %d", tc.ttl, tc.advance, tc.want, got)
+		}
+	}
+}
+
+func TestCachingResolverSize(t *testing.T) {
+	ctx := context.Background()
+	upstream := newCountingResolver(setUp().Resolver)
+	c, _ := newTestCache(upstream, 2)
+
+	c.LookupIPAddr(ctx, "valid.example.com")
+	c.LookupIPAddr(ctx, "mismatched.example.com")
+	c.LookupIPAddr(ctx, "valid.example.com")
+	// Evicts mismatched.example.com, the least recently used.
+	c.LookupIPAddr(ctx, "cname-for-valid.example.com")
+	c.LookupIPAddr(ctx, "valid.example.com")
+	c.LookupIPAddr(ctx, "mismatched.example.com")
+
+	if got := upstream.count("valid.example.com"); got != 1 {
+		t.Errorf("upstream lookups of recently used name: want 1, got: %d", got)
+	}
+	if got := upstream.count("mismatched.example.com"); got != 2 {
+		t.Errorf("upstream lookups of evicted name: want 2, got: %d", got)
+	}
+}
+
+func TestCachingResolverCoalesce(t *testing.T) {
+	upstream := newCountingResolver(setUp().Resolver)
+	upstream.release = make(chan struct{})
+	c, _ := newTestCache(upstream, 10)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := c.LookupIPAddr(context.Background(), "valid.example.com")
+			errs <- err
+		}()
+	}
+	// A caller that gives up does not cancel the shared lookup.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.LookupIPAddr(ctx, "valid.example.com"); !errors.Is(err, context.Canceled) {
+		t.Errorf("LookupIPAddr(canceled): want context.Canceled, got: %v", err)
+	}
+	for upstream.count("valid.example.com") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(upstream.release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("LookupIPAddr(): %v", err)
+		}
+	}
+	if got := upstream.count("valid.example.com"); got != 1 {
+		t.Errorf("upstream lookups of concurrently resolved name: want 1, got: %d", got)
+	}
+}
+
+func TestCachingResolverTimeout(t *testing.T) {
+	c := NewCachingResolver(hungResolver{}, 10, time.Minute, time.Minute, 10*time.Millisecond)
+	done := make(chan error, 1)
+	go func() {
+		// The caller's context never ends, the shared query must still.
+		_, err := c.LookupIPAddr(context.Background(), "valid.example.com")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("LookupIPAddr(hung upstream): want context.DeadlineExceeded, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("LookupIPAddr(hung upstream): shared query did not time out")
+	}
+}
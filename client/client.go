@@ -18,30 +18,50 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto"
 	"crypto/tls"
-	"encoding/pem"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"math"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	cs "github.com/icemarkom/certsync"
 	"github.com/icemarkom/certsync/common"
 )
 
+// Exit codes. exitFailure is also that of common.Fatal.
+const (
+	exitFailure       = 1
+	exitInvalidBundle = 3
+	exitHookFailed    = 4
+)
+
 var (
-	cfg *cs.Config
+	cfg     *cs.Config
+	metrics *clientMetrics
 
 	binaryName, version, gitCommit string
 )
 
 func init() {
-	var v bool
+	var (
+		v, printConfig bool
+		configFile     string
+	)
 
 	cfg = cs.NewConfig(binaryName, version, gitCommit)
 
@@ -51,15 +71,36 @@ func init() {
 	flag.IntVar(&cfg.Port, "port", cs.DefaultPort, "Server port")
 	flag.StringVar(&cfg.CertFile, "clientcert", cs.DefaultCertFile, "Client certificate file")
 	flag.StringVar(&cfg.CertKeyFile, "clientkey", cs.DefaultKeyFile, "Client private key file")
+	flag.StringVar(&cfg.CACertFile, "ca", "", "Server CA certificate file. If empty, system roots are used.")
+	common.StringsVar(&cfg.ServerPins, "pin", "Base64 SHA-256 of a public key (SPKI) that must appear in the server's certificate chain. May be repeated.")
 	flag.BoolVar(&cfg.DryRun, "dry_run", true, "Dry run - don't connect to the server")
 	flag.StringVar(&cfg.NewCertFile, "newcert", cs.DefaultNewCertFile, "New certificate file")
 	flag.StringVar(&cfg.NewCertKeyFile, "newkey", cs.DefaultNewKeyFile, "New key file")
+	flag.StringVar(&cfg.BundleName, "bundle", "", "Name of the bundle to fetch. If empty, server picks the default for this client.")
 	flag.DurationVar(&cfg.Timeout, "timeout", cs.DefaultTimeout*time.Second, "Server timeout in seconds")
-	flag.BoolVar(&v, "version", false, "Print version and exit.")
+	flag.StringVar(&cfg.BundleCAFile, "bundle_ca", "", "CA certificate file the received bundle must chain to. If empty, system roots are used.")
+	flag.StringVar(&cfg.ExpectedName, "expect_name", "", "If set, the received certificate must be valid for this name.")
+	common.StringsVar(&cfg.Hooks, "hook", "Command to run (with /bin/sh -c) after new certificate or key is installed. May be repeated.")
+	flag.DurationVar(&cfg.HookTimeout, "hook_timeout", cs.DefaultHookTimeout*time.Second, "Maximum run time of each hook.")
+	flag.BoolVar(&cfg.CSR, "csr", false, "Generate a key locally and have the server sign a CSR for it, instead of fetching a bundle.")
+	flag.StringVar(&cfg.IdentityPolicy, "identity", cs.DefaultIdentityPolicy, "CSR mode: comma separated client certificate identities, in order of preference: dns, ip, uri (SANs) and cn. The first one found is requested, and must be the one the server validates.")
+	flag.StringVar(&cfg.KeyType, "key_type", cs.DefaultKeyType, "CSR mode: type of key to generate: ecdsa-p256, ecdsa-p384, ed25519, rsa-2048 or rsa-4096.")
+	flag.BoolVar(&cfg.WrapKeys, "wrap_key", false, "Ask the server to encrypt the private key to this client, so it is never sent in cleartext.")
+	flag.StringVar(&cfg.UnwrapKeyFile, "unwrap_key", "", "PKCS#8 ECDSA or X25519 key registered with the server for unwrapping keys. If empty, clientkey is used.")
+	flag.BoolVar(&cfg.Daemon, "daemon", false, "Keep running and fetch a new certificate before the installed one expires.")
+	flag.DurationVar(&cfg.RenewJitter, "renew_jitter", cs.DefaultRenewJitter*time.Second, "Daemon mode: maximum random amount by which to advance each renewal.")
+	flag.DurationVar(&cfg.RetryMax, "retry_max", cs.DefaultRetryMax*time.Second, "Daemon mode: maximum delay between retries of failed fetches.")
+	flag.DurationVar(&cfg.MaxInterval, "max_interval", cs.DefaultMaxInterval*time.Second, "Daemon mode: maximum delay between fetches.")
+	flag.StringVar(&cfg.TextfileName, "textfile", "", "Write metrics of each run to this file for the node_exporter textfile collector. Should end in .prom.")
+	flag.StringVar(&cfg.MetricsAddr, "metrics", "", "Daemon mode: listen address for Prometheus /metrics, e.g. localhost:9183. If empty, metrics are not served.")
+	common.LogFlags(cfg)
+	flag.BoolVar(&v, common.FlagVersion, false, "Print version and exit.")
+	flag.StringVar(&configFile, common.FlagConfig, "", "JSON configuration file keyed by flag name. Overridden by CERTSYNC_* environment variables, which are overridden by flags.")
+	flag.BoolVar(&printConfig, common.FlagPrintConfig, false, "Print the effective configuration and exit.")
 
 	flag.Parse()
 
-	if len(os.Args) == 1 {
+	if !common.Configured(os.Args, os.Environ()) {
 		common.ProgramUsage(cfg)
 		os.Exit(0)
 	}
@@ -69,11 +110,23 @@ func init() {
 		os.Exit(0)
 	}
 
+	if err := common.LoadConfig(configFile, printConfig); err != nil {
+		common.Fatal("Cannot load configuration", cs.ErrAttr(err))
+	}
+	if err := common.SetupLogging(cfg); err != nil {
+		common.Fatal("Invalid configuration", cs.ErrAttr(err))
+	}
+
 	if cfg.HostName == "" {
-		log.Fatalf("Server hostname not specified.\n\n")
+		common.Fatal("Server hostname not specified")
+	}
+	if cfg.Daemon {
+		if err := cs.CheckSchedule(cfg); err != nil {
+			common.Fatal("Invalid configuration", cs.ErrAttr(err))
+		}
 	}
 	if cfg.Port < 1 && cfg.Port > math.MaxInt16 {
-		log.Printf("Invalid port number: %d.", cfg.Port)
+		slog.Warn("Invalid port number", "port", cfg.Port)
 	}
 }
 
@@ -85,9 +138,16 @@ func setupClient() (*http.Client, error) {
 
 	tc := &tls.Config{
 		Certificates: []tls.Certificate{cert},
-		ClientAuth:   tls.RequireAndVerifyClientCert,
 		MinVersion:   tls.VersionTLS13,
 	}
+	if cfg.CACertFile != "" {
+		if tc.RootCAs, err = cs.LoadCertPool(cfg.CACertFile); err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.ServerPins) != 0 {
+		tc.VerifyPeerCertificate = cs.VerifyPins(cfg.ServerPins)
+	}
 
 	return &http.Client{
 		Transport: &http.Transport{
@@ -97,110 +157,397 @@ func setupClient() (*http.Client, error) {
 	}, nil
 }
 
-func parsePEM(data []byte) ([]*pem.Block, error) {
+// saveData verifies and installs the received bundle. It reports whether the
+// installed files changed.
+func saveData(data []byte) (bool, error) {
+	certPEM, keyPEM, ignored, err := cs.SplitBundle(data)
+	if err != nil {
+		return false, err
+	}
+	if ignored != 0 {
+		slog.Warn("Ignoring PEM blocks that are not certificates or private keys", "blocks", ignored)
+	}
+	opts := cs.VerifyOptions{DNSName: cfg.ExpectedName}
+	if cfg.BundleCAFile != "" {
+		if opts.Roots, err = cs.LoadCertPool(cfg.BundleCAFile); err != nil {
+			return false, err
+		}
+	}
+	if _, err := cs.VerifyBundle(certPEM, keyPEM, opts); err != nil {
+		return false, err
+	}
+	oldFingerprint, err := cs.FilesFingerprint(cfg.NewCertFile, cfg.NewCertKeyFile)
+	if err != nil {
+		return false, err
+	}
+	if oldFingerprint == cs.Fingerprint(certPEM, keyPEM) {
+		return false, nil
+	}
+	err = cs.WriteAtomic(
+		cs.AtomicFile{Name: cfg.NewCertFile, Data: certPEM, Mode: 0600},
+		cs.AtomicFile{Name: cfg.NewCertKeyFile, Data: keyPEM, Mode: 0600},
+	)
+	if err != nil {
+		return false, fmt.Errorf("cannot save certificate and key: %v", err)
+	}
+	return true, nil
+}
+
+// decodeBundle returns the PEM form of a JSON bundle response, and the
+// fingerprint the server computed for it.
+func decodeBundle(body []byte) ([]byte, string, error) {
+	var b cs.BundleResponse
+	if err := json.Unmarshal(body, &b); err != nil {
+		return nil, "", fmt.Errorf("cannot decode bundle response: %v", err)
+	}
+	data, err := b.PEM()
+	if err != nil {
+		return nil, "", err
+	}
+	slog.Info("Received bundle", cs.LogKeyBundle, b.Name, "serial", b.Serial, "not_before", b.NotBefore, "not_after", b.NotAfter)
+	return data, b.Fingerprint, nil
+}
+
+// unwrapBundle decrypts the wrapped private key in data with the unwrap key,
+// or the client key if none is configured.
+func unwrapBundle(data []byte) ([]byte, error) {
 	var (
-		pemList []*pem.Block
-		err     error
+		key crypto.PrivateKey
+		err error
 	)
+	if cfg.UnwrapKeyFile != "" {
+		key, err = cs.ReadUnwrapKey(cfg.UnwrapKeyFile)
+	} else {
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(cfg.CertFile, cfg.CertKeyFile)
+		key = cert.PrivateKey
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot load key to unwrap bundle: %v", err)
+	}
+	return cs.UnwrapBundle(data, key)
+}
 
-	for {
-		block, rest := pem.Decode(data)
-		if block == nil {
-			break
-		}
-		pemList = append(pemList, block)
-		data = rest
-		if len(rest) == 0 {
-			break
+// installedFingerprint returns the fingerprint of the installed certificate
+// and key, or an empty string if either of them is missing.
+func installedFingerprint() string {
+	for _, f := range []string{cfg.NewCertFile, cfg.NewCertKeyFile} {
+		if _, err := os.Stat(f); err != nil {
+			return ""
 		}
 	}
-	if len(pemList) == 0 {
-		err = fmt.Errorf("no PEM blocks found")
+	fp, err := cs.FilesFingerprint(cfg.NewCertFile, cfg.NewCertKeyFile)
+	if err != nil {
+		return ""
 	}
-	return pemList, err
+	return fp
 }
 
-func savePEM(blocks []*pem.Block, fileName string, fileMode os.FileMode) (err error) {
+// hookState records failed hooks across runs.
+func hookState() cs.HookState {
+	return cs.HookState{FileName: cfg.NewCertFile + ".hooks_failed"}
+}
 
-	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, fileMode)
-	defer func() {
-		err = f.Close()
-	}()
-	if err != nil {
-		return fmt.Errorf("cannot write to %q: %v", fileName, err)
+// installHooks runs the hooks if the installed files changed, or if they
+// failed for the files installed now. A failure is recorded, so that later
+// runs retry the hooks until they succeed.
+func installHooks(ctx context.Context, changed bool) error {
+	state, fp := hookState(), installedFingerprint()
+	if !changed {
+		if !state.Pending(fp) {
+			return nil
+		}
+		slog.Info("Retrying hooks that failed for the installed certificate")
 	}
-	for _, block := range blocks {
-		err = pem.Encode(f, block)
-		if err != nil {
-			return fmt.Errorf("cannnot write PEM block to %q: %v", fileName, err)
+	if err := runHooks(ctx); err != nil {
+		if serr := state.Failed(fp); serr != nil {
+			slog.Error("Cannot record failed hooks, they will not be retried", cs.LogKeyFile, state.FileName, cs.ErrAttr(serr))
 		}
+		return err
+	}
+	if err := state.Succeeded(); err != nil {
+		slog.Warn("Cannot clear record of failed hooks", cs.LogKeyFile, state.FileName, cs.ErrAttr(err))
 	}
 	return nil
 }
 
-func saveData(data []byte) error {
-	var certs, keys, others []*pem.Block
+// runHooks runs all configured hooks, logging their output. All hooks are run
+// even if some fail.
+func runHooks(ctx context.Context) error {
+	var errs []error
 
-	pemList, err := parsePEM(data)
-	if err != nil {
-		return fmt.Errorf("cannot parse PEM data: %v", err)
+	env := []string{
+		"CERTSYNC_CERT_FILE=" + cfg.NewCertFile,
+		"CERTSYNC_KEY_FILE=" + cfg.NewCertKeyFile,
 	}
-	for _, block := range pemList {
-		if block.Type == cs.PEMTypeCertificate {
-			certs = append(certs, block)
-			continue
+	for _, h := range cfg.Hooks {
+		out, err := cs.RunHook(ctx, h, cfg.HookTimeout, env...)
+		for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+			if line != "" {
+				slog.Info("Hook output", "hook", h, "output", line)
+			}
 		}
-		if block.Type == cs.PEMTypePrivateKey {
-			keys = append(keys, block)
+		if err != nil {
+			errs = append(errs, err)
 			continue
 		}
-		others = append(others, block)
+		slog.Info("Hook completed", "hook", h)
 	}
-	if len(others) != 0 {
-		log.Printf("Ignoring %d PEM blocks that are not %q or %q.", len(others), cs.PEMTypeCertificate, cs.PEMTypePrivateKey)
+	return errors.Join(errs...)
+}
+
+func serverURL(path string) *url.URL {
+	return &url.URL{
+		Scheme: "https",
+		Host:   net.JoinHostPort(cfg.HostName, strconv.Itoa(cfg.Port)),
+		Path:   path,
 	}
-	err = savePEM(certs, cfg.NewCertFile, 0600)
-	if err != nil {
-		return fmt.Errorf("cannot save certs: %v", err)
+}
+
+// newBundleRequest asks the server for a bundle, unless it matches the
+// installed one. Servers without the JSON API answer with PEM.
+func newBundleRequest() (*http.Request, error) {
+	u := serverURL(cs.BundlePathV1)
+	if cfg.BundleName != "" {
+		u.RawQuery = url.Values{"bundle": {cfg.BundleName}}.Encode()
 	}
-	err = savePEM(keys, cfg.NewCertKeyFile, 0600)
+	req, err := http.NewRequest(http.MethodGet, u.String(), bytes.NewBuffer([]byte{}))
 	if err != nil {
-		return fmt.Errorf("cannot save keys: %v", err)
+		return nil, err
 	}
-	return nil
+	req.Header.Set("Accept", cs.ContentTypeJSON+", "+cs.ContentTypePEM)
+	if fp := installedFingerprint(); fp != "" {
+		req.Header.Set("If-None-Match", strconv.Quote(fp))
+	}
+	if cfg.WrapKeys {
+		req.Header.Set(cs.HeaderKeyWrap, cs.KeyWrapHPKE)
+	}
+	return req, nil
 }
 
-func main() {
-	client, err := setupClient()
+// newCSRRequest generates a new key and asks the server to sign it for the
+// first identity of the client certificate allowed by cfg.IdentityPolicy. The
+// returned key is to be installed with the certificate chain in the response.
+func newCSRRequest() (*http.Request, []byte, error) {
+	clientCert, err := cs.ReadCertificate(cfg.CertFile)
 	if err != nil {
-		log.Fatalf("Could not setup HTTPS client: %v", err)
+		return nil, nil, err
 	}
-	if cfg.DryRun {
-		log.Println("Dry run - not connecting to the server.")
-		os.Exit(0)
+	policy, err := cs.ParseIdentityPolicy(cfg.IdentityPolicy)
+	if err != nil {
+		return nil, nil, err
+	}
+	ids := cs.Identities(clientCert, policy)
+	if len(ids) == 0 {
+		return nil, nil, fmt.Errorf("client certificate has no identity allowed by policy %q", cfg.IdentityPolicy)
+	}
+	key, err := cs.GenerateKey(cfg.KeyType)
+	if err != nil {
+		return nil, nil, err
 	}
-	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("https://%s:%d", cfg.HostName, cfg.Port), bytes.NewBuffer([]byte{}))
+	keyPEM, err := cs.EncodeKey(key)
 	if err != nil {
-		log.Fatalf("Cannot create HTTPS request: %v", err)
+		return nil, nil, err
+	}
+	csr, err := cs.NewCSR(key, ids[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, serverURL(cs.CSRPath).String(), bytes.NewReader(csr))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/pkcs10")
+	return req, keyPEM, nil
+}
+
+// fetch retrieves and installs a bundle from the server. It reports whether
+// the installed files changed.
+func fetch(client *http.Client) (bool, error) {
+	var (
+		req    *http.Request
+		keyPEM []byte
+		err    error
+	)
+	if cfg.CSR {
+		req, keyPEM, err = newCSRRequest()
+	} else {
+		req, err = newBundleRequest()
+	}
+	if err != nil {
+		return false, fmt.Errorf("cannot create HTTPS request: %v", err)
 	}
 
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Fatalf("Cannot complete HTTPS request: %v", err)
+		return false, fmt.Errorf("cannot complete HTTPS request: %v", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotModified {
+		return false, nil
+	}
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Fatalf("Error reading response body: %v", err)
+		return false, fmt.Errorf("error reading response body: %v", err)
 	}
 	if resp.StatusCode != http.StatusOK {
-		fmt.Println(resp.StatusCode)
-		log.Fatalf("Received %d (%q) from the server. Full response: %q", resp.StatusCode, http.StatusText(resp.StatusCode), strings.TrimSpace(string(body)))
+		return false, fmt.Errorf("received %d (%q) from the server. Full response: %q", resp.StatusCode, http.StatusText(resp.StatusCode), strings.TrimSpace(string(body)))
+	}
+	var fingerprint string
+	if mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mt == cs.ContentTypeJSON {
+		if body, fingerprint, err = decodeBundle(body); err != nil {
+			return false, err
+		}
+	}
+	if resp.Header.Get(cs.HeaderKeyWrap) != "" {
+		if body, err = unwrapBundle(body); err != nil {
+			return false, err
+		}
+	} else if cfg.WrapKeys && !cfg.CSR {
+		return false, errors.New("server did not wrap the private key")
 	}
+	if fingerprint != "" {
+		if fp, err := cs.BundleFingerprint(body); err != nil || fp != fingerprint {
+			return false, fmt.Errorf("%w: fingerprint does not match", cs.ErrInvalidBundle)
+		}
+	}
+
+	changed, err := saveData(append(body, keyPEM...))
+	if err != nil {
+		return false, fmt.Errorf("error saving data: %w", err)
+	}
+	return changed, nil
+}
 
-	err = saveData(body)
+// nextFetch returns how long to wait before fetching again, based on the
+// currently installed certificate. The second return value reports whether
+// the installed certificate is already due for renewal.
+func nextFetch(now time.Time) (time.Duration, bool) {
+	cert, err := cs.ReadCertificate(cfg.NewCertFile)
 	if err != nil {
-		log.Fatalf("Error saving data: %v", err)
+		slog.Warn("Cannot read installed certificate", cs.LogKeyFile, cfg.NewCertFile, cs.ErrAttr(err))
+		return 0, true
+	}
+	d := cs.RenewalTime(cert, cs.DefaultRenewFraction, cfg.RenewJitter).Sub(now)
+	if d <= 0 {
+		return 0, true
+	}
+	if d > cfg.MaxInterval {
+		d = cfg.MaxInterval
+	}
+	return d, false
+}
+
+func runDaemon(ctx context.Context) {
+	var attempt int
+
+	wait, _ := nextFetch(time.Now())
+	for {
+		slog.Info("Next fetch scheduled", "wait", wait.Round(time.Second))
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			slog.Info("Signal received, exiting")
+			return
+		case <-t.C:
+		}
+
+		var changed bool
+		start := time.Now()
+		client, err := setupClient()
+		if err == nil {
+			changed, err = fetch(client)
+		}
+		if err != nil {
+			metrics.record(start, resultCode(err))
+			wait = cs.Backoff(attempt, cs.DefaultRetryMin*time.Second, cfg.RetryMax)
+			attempt++
+			slog.Error("Fetch failed", "attempt", attempt, cs.ErrAttr(err))
+			continue
+		}
+		if !changed {
+			slog.Info("Certificate unchanged")
+		} else {
+			slog.Info("New certificate installed", cs.LogKeyFile, cfg.NewCertFile)
+		}
+		if err := installHooks(ctx, changed); err != nil {
+			metrics.record(start, exitHookFailed)
+			wait = cs.Backoff(attempt, cs.DefaultRetryMin*time.Second, cfg.RetryMax)
+			attempt++
+			slog.Error("Hooks failed", "attempt", attempt, cs.ErrAttr(err))
+			continue
+		}
+		metrics.record(start, 0)
+
+		var due bool
+		wait, due = nextFetch(time.Now())
+		if due {
+			// The server handed out a certificate that is already due for
+			// renewal. Back off instead of asking for it again right away.
+			wait = cs.Backoff(attempt, cs.DefaultRetryMin*time.Second, cfg.RetryMax)
+			attempt++
+			slog.Warn("Installed certificate is still due for renewal")
+			continue
+		}
+		attempt = 0
+	}
+}
+
+func main() {
+	start := time.Now()
+	metrics = newClientMetrics()
+	client, err := setupClient()
+	if err != nil {
+		// Record the failure, so that the textfile does not keep showing the
+		// last success.
+		if !cfg.DryRun {
+			metrics.record(start, exitFailure)
+		}
+		common.Fatal("Could not setup HTTPS client", cs.ErrAttr(err))
+	}
+	if cfg.DryRun {
+		slog.Info("Dry run - not connecting to the server")
+		os.Exit(0)
+	}
+	if cfg.Daemon {
+		if cfg.MetricsAddr != "" {
+			if err := metrics.serve(); err != nil {
+				common.Fatal("Unable to serve metrics", cs.ErrAttr(err))
+			}
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+		runDaemon(ctx)
+		return
+	}
+	code := runOnce(client)
+	metrics.record(start, code)
+	if code != 0 {
+		os.Exit(code)
+	}
+}
+
+// runOnce fetches and installs a bundle, and returns the exit code.
+func runOnce(client *http.Client) int {
+	changed, err := fetch(client)
+	if err != nil {
+		if errors.Is(err, cs.ErrInvalidBundle) {
+			slog.Error("Keeping previously installed files", cs.ErrAttr(err))
+		} else {
+			slog.Error("Fetch failed", cs.ErrAttr(err))
+		}
+		return resultCode(err)
+	}
+	if !changed {
+		slog.Info("Certificate unchanged")
+	} else {
+		slog.Info("New certificate installed", cs.LogKeyFile, cfg.NewCertFile)
+	}
+	if err := installHooks(context.Background(), changed); err != nil {
+		slog.Error("Hooks failed", cs.ErrAttr(err))
+		return exitHookFailed
 	}
+	return 0
 }
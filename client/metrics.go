@@ -0,0 +1,136 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	cs "github.com/icemarkom/certsync"
+	"github.com/icemarkom/certsync/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+const metricLastSuccess = "certsync_client_last_success_timestamp_seconds"
+
+// clientMetrics describes the outcome of the latest run, for the node_exporter
+// textfile collector and, in daemon mode, for scraping.
+type clientMetrics struct {
+	reg                                  *prometheus.Registry
+	lastAttempt, lastSuccess, lastResult prometheus.Gauge
+	notAfter                             prometheus.Gauge
+	certInfo                             *prometheus.GaugeVec
+}
+
+func newClientMetrics() *clientMetrics {
+	labels := prometheus.Labels{"cert": cfg.NewCertFile}
+	gauge := func(name, help string) prometheus.Gauge {
+		return prometheus.NewGauge(prometheus.GaugeOpts{Name: name, Help: help, ConstLabels: labels})
+	}
+	m := &clientMetrics{
+		reg:         prometheus.NewRegistry(),
+		lastAttempt: gauge("certsync_client_last_attempt_timestamp_seconds", "Time of the last fetch attempt."),
+		lastSuccess: gauge(metricLastSuccess, "Time of the last successful fetch."),
+		lastResult:  gauge("certsync_client_last_result", "Exit code of the last run: 0 success, 1 error, 3 invalid bundle, 4 hook failure."),
+		notAfter:    gauge("certsync_client_cert_not_after_timestamp_seconds", "NotAfter of the installed certificate."),
+		certInfo: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        "certsync_client_cert_info",
+			Help:        "Fingerprint of the installed certificate and key.",
+			ConstLabels: labels,
+		}, []string{"fingerprint"}),
+	}
+	m.reg.MustRegister(m.lastAttempt, m.lastSuccess, m.lastResult, m.notAfter, m.certInfo)
+	if cfg.TextfileName != "" {
+		m.lastSuccess.Set(previousSuccess(cfg.TextfileName))
+	}
+	m.updateInstalled()
+	return m
+}
+
+// previousSuccess returns the last success time from an earlier textfile, so
+// that it survives failed one-shot runs.
+func previousSuccess(fileName string) float64 {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	p := expfmt.NewTextParser(model.UTF8Validation)
+	families, err := p.TextToMetricFamilies(f)
+	if err != nil {
+		return 0
+	}
+	mf, ok := families[metricLastSuccess]
+	if !ok || len(mf.GetMetric()) == 0 {
+		return 0
+	}
+	return mf.GetMetric()[0].GetGauge().GetValue()
+}
+
+// updateInstalled exports the installed certificate.
+func (m *clientMetrics) updateInstalled() {
+	m.notAfter.Set(0)
+	if cert, err := cs.ReadCertificate(cfg.NewCertFile); err == nil {
+		m.notAfter.Set(float64(cert.NotAfter.Unix()))
+	}
+	m.certInfo.Reset()
+	if fp := installedFingerprint(); fp != "" {
+		m.certInfo.WithLabelValues(fp).Set(1)
+	}
+}
+
+// record exports the result of a run started at start, and writes the
+// textfile if one is configured.
+func (m *clientMetrics) record(start time.Time, code int) {
+	m.lastAttempt.Set(float64(start.Unix()))
+	m.lastResult.Set(float64(code))
+	if code == 0 {
+		m.lastSuccess.Set(float64(time.Now().Unix()))
+	}
+	m.updateInstalled()
+	if cfg.TextfileName == "" {
+		return
+	}
+	if err := prometheus.WriteToTextfile(cfg.TextfileName, m.reg); err != nil {
+		slog.Error("Cannot write metrics textfile", cs.LogKeyFile, cfg.TextfileName, cs.ErrAttr(err))
+	}
+}
+
+// serve exposes the metrics on cfg.MetricsAddr.
+func (m *clientMetrics) serve() error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.reg, promhttp.HandlerOpts{}))
+	if err := common.Serve("Metrics", cfg.MetricsAddr, mux, cfg.Timeout, nil); err != nil {
+		return err
+	}
+	slog.Info("Serving metrics", cs.LogKeyAddr, cfg.MetricsAddr)
+	return nil
+}
+
+// resultCode returns the exit code for a failed fetch.
+func resultCode(err error) int {
+	if errors.Is(err, cs.ErrInvalidBundle) {
+		return exitInvalidBundle
+	}
+	return exitFailure
+}
@@ -0,0 +1,237 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Names of the flags that control configuration loading itself.
+const (
+	FlagConfig      = "config"
+	FlagPrintConfig = "print-config"
+	FlagVersion     = "version"
+
+	envPrefix = "CERTSYNC_"
+)
+
+var configFlags = map[string]bool{
+	FlagConfig:      true,
+	FlagPrintConfig: true,
+	FlagVersion:     true,
+}
+
+// stringsValue is a repeatable flag that appends to a slice.
+type stringsValue []string
+
+func (s *stringsValue) String() string {
+	if s == nil {
+		return ""
+	}
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsValue) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+func (s *stringsValue) Get() any {
+	return []string(*s)
+}
+
+// StringsVar defines a repeatable string flag. Each occurrence is appended to p.
+func StringsVar(p *[]string, name, usage string) {
+	FlagSetStringsVar(flag.CommandLine, p, name, usage)
+}
+
+// FlagSetStringsVar is StringsVar for a specific flag set.
+func FlagSetStringsVar(fs *flag.FlagSet, p *[]string, name, usage string) {
+	fs.Var((*stringsValue)(p), name, usage)
+}
+
+// EnvName returns the environment variable that sets the named flag.
+func EnvName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(flagName))
+}
+
+// Configured reports whether the program was given any options: arguments
+// besides the program name in args, or CERTSYNC_* variables in environ.
+func Configured(args, environ []string) bool {
+	if len(args) > 1 {
+		return true
+	}
+	for _, kv := range environ {
+		if strings.HasPrefix(kv, envPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ApplyConfig sets all flags in fs that were not set on the command line,
+// first from the JSON config file (if fileName is not empty) and then from
+// CERTSYNC_* variables in environ. The config file is an object keyed by flag
+// name; repeatable flags take a list. In the environment, repeatable flags
+// take one item per line, since items such as hook commands may contain
+// commas. Must be called after fs.Parse.
+func ApplyConfig(fs *flag.FlagSet, fileName string, environ []string) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	if fileName != "" {
+		values, err := readConfigFile(fileName)
+		if err != nil {
+			return err
+		}
+		for name, raw := range values {
+			f := fs.Lookup(name)
+			if f == nil || configFlags[name] {
+				return fmt.Errorf("config file %q: unknown option %q", fileName, name)
+			}
+			if set[name] {
+				continue
+			}
+			if err := setFromJSON(f, raw); err != nil {
+				return fmt.Errorf("config file %q: option %q: %v", fileName, name, err)
+			}
+		}
+	}
+
+	env := make(map[string]string)
+	for _, kv := range environ {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			env[k] = v
+		}
+	}
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		v, ok := env[EnvName(f.Name)]
+		if !ok || set[f.Name] || configFlags[f.Name] || err != nil {
+			return
+		}
+		if _, isList := f.Value.(*stringsValue); isList {
+			*f.Value.(*stringsValue) = nil
+			for _, item := range strings.Split(v, "\n") {
+				if item = strings.TrimSpace(item); item != "" {
+					f.Value.Set(item)
+				}
+			}
+			return
+		}
+		if serr := f.Value.Set(v); serr != nil {
+			err = fmt.Errorf("environment variable %s: %v", EnvName(f.Name), serr)
+		}
+	})
+	return err
+}
+
+func readConfigFile(fileName string) (map[string]json.RawMessage, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read config file %q: %v", fileName, err)
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("cannot parse config file %q: %v", fileName, err)
+	}
+	return values, nil
+}
+
+func setFromJSON(f *flag.Flag, raw json.RawMessage) error {
+	if list, isList := f.Value.(*stringsValue); isList {
+		var items []string
+		if err := json.Unmarshal(raw, &items); err != nil {
+			return fmt.Errorf("want a list of strings: %v", err)
+		}
+		*list = items
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return f.Value.Set(s)
+	}
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	var v any
+	if err := d.Decode(&v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case json.Number:
+		return f.Value.Set(v.String())
+	case bool:
+		return f.Value.Set(fmt.Sprint(v))
+	}
+	return fmt.Errorf("unsupported value %s", raw)
+}
+
+// PrintConfig writes the effective configuration of fs to w, in the format
+// accepted by ApplyConfig.
+func PrintConfig(fs *flag.FlagSet, w io.Writer) error {
+	values := make(map[string]any)
+	fs.VisitAll(func(f *flag.Flag) {
+		if configFlags[f.Name] {
+			return
+		}
+		if g, ok := f.Value.(flag.Getter); ok {
+			switch v := g.Get().(type) {
+			case []string:
+				if v == nil {
+					v = []string{}
+				}
+				values[f.Name] = v
+				return
+			case bool, int, string:
+				values[f.Name] = v
+				return
+			}
+		}
+		values[f.Name] = f.Value.String()
+	})
+	data, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(data))
+	return err
+}
+
+// LoadConfig applies the config file and environment to flag.CommandLine,
+// prints the effective configuration and exits if requested. The config file
+// name may also come from CERTSYNC_CONFIG.
+func LoadConfig(fileName string, printConfig bool) error {
+	if fileName == "" {
+		fileName = os.Getenv(EnvName(FlagConfig))
+	}
+	if err := ApplyConfig(flag.CommandLine, fileName, os.Environ()); err != nil {
+		return err
+	}
+	if printConfig {
+		if err := PrintConfig(flag.CommandLine, os.Stdout); err != nil {
+			return err
+		}
+		os.Exit(0)
+	}
+	return nil
+}
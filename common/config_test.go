@@ -0,0 +1,177 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testConfig struct {
+	host    string
+	port    int
+	dryRun  bool
+	timeout time.Duration
+	hooks   []string
+}
+
+func newTestFlagSet(c *testConfig) *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.StringVar(&c.host, "host", "", "")
+	fs.IntVar(&c.port, "port", 82, "")
+	fs.BoolVar(&c.dryRun, "dry_run", true, "")
+	fs.DurationVar(&c.timeout, "timeout", 30*time.Second, "")
+	fs.Var((*stringsValue)(&c.hooks), "hook", "")
+	fs.String(FlagConfig, "", "")
+	return fs
+}
+
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(p, []byte(data), 0600); err != nil {
+		t.Fatalf("cannot write %q: %v", p, err)
+	}
+	return p
+}
+
+func TestApplyConfig(t *testing.T) {
+	file := writeConfig(t, `{
+		"host": "file.example.com",
+		"port": 443,
+		"dry_run": false,
+		"timeout": "10s",
+		"hook": ["a", "b"]
+	}`)
+
+	var tests = []struct {
+		desc    string
+		args    []string
+		environ []string
+		want    testConfig
+	}{
+		{
+			desc: "file only",
+			want: testConfig{host: "file.example.com", port: 443, timeout: 10 * time.Second, hooks: []string{"a", "b"}},
+		},
+		{
+			desc:    "environment overrides file",
+			environ: []string{"CERTSYNC_PORT=8443", "CERTSYNC_HOOK=c\n\nd", "CERTSYNC_CONFIG=ignored", "OTHER=1"},
+			want:    testConfig{host: "file.example.com", port: 8443, timeout: 10 * time.Second, hooks: []string{"c", "d"}},
+		},
+		{
+			desc:    "commas in environment list items",
+			environ: []string{"CERTSYNC_HOOK=systemctl reload nginx, apache2"},
+			want:    testConfig{host: "file.example.com", port: 443, timeout: 10 * time.Second, hooks: []string{"systemctl reload nginx, apache2"}},
+		},
+		{
+			desc:    "flags override environment and file",
+			args:    []string{"-port", "9000", "-hook", "e", "-dry_run"},
+			environ: []string{"CERTSYNC_PORT=8443", "CERTSYNC_HOOK=c"},
+			want:    testConfig{host: "file.example.com", port: 9000, dryRun: true, timeout: 10 * time.Second, hooks: []string{"e"}},
+		},
+	}
+	for _, tc := range tests {
+		var got testConfig
+		fs := newTestFlagSet(&got)
+		if err := fs.Parse(tc.args); err != nil {
+			t.Fatalf("%s: Parse(): %v", tc.desc, err)
+		}
+		if err := ApplyConfig(fs, file, tc.environ); err != nil {
+			t.Errorf("%s: ApplyConfig(): %v", tc.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: ApplyConfig(): want: %+v, got: %+v", tc.desc, tc.want, got)
+		}
+	}
+}
+
+func TestConfigured(t *testing.T) {
+	var tests = []struct {
+		args, environ []string
+		want          bool
+	}{
+		{args: []string{"prog"}, environ: []string{"HOME=/root"}, want: false},
+		{args: []string{"prog", "-host", "example.com"}, want: true},
+		{args: []string{"prog"}, environ: []string{"CERTSYNC_CONFIG=certsync.json"}, want: true},
+		{args: []string{"prog"}, environ: []string{"HOME=/root", "CERTSYNC_HOST=example.com"}, want: true},
+	}
+	for _, tc := range tests {
+		if got := Configured(tc.args, tc.environ); got != tc.want {
+			t.Errorf("Configured(%q, %q): want: %v, got: %v", tc.args, tc.environ, tc.want, got)
+		}
+	}
+}
+
+func TestApplyConfigErrors(t *testing.T) {
+	var tests = []struct {
+		desc    string
+		file    string
+		environ []string
+	}{
+		{desc: "unknown option", file: `{"nope": 1}`},
+		{desc: "config option in file", file: `{"config": "other.json"}`},
+		{desc: "bad JSON", file: `{`},
+		{desc: "bad value", file: `{"port": "many"}`},
+		{desc: "bad list", file: `{"hook": "a"}`},
+		{desc: "bad environment value", file: `{}`, environ: []string{"CERTSYNC_TIMEOUT=forever"}},
+	}
+	for _, tc := range tests {
+		var c testConfig
+		fs := newTestFlagSet(&c)
+		fs.Parse(nil)
+		if err := ApplyConfig(fs, writeConfig(t, tc.file), tc.environ); err == nil {
+			t.Errorf("%s: ApplyConfig(): want error, got nil", tc.desc)
+		}
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	var c testConfig
+	fs := newTestFlagSet(&c)
+	fs.Parse([]string{"-host", "h.example.com", "-hook", "a"})
+
+	var buf bytes.Buffer
+	if err := PrintConfig(fs, &buf); err != nil {
+		t.Fatalf("PrintConfig(): %v", err)
+	}
+
+	// The output must be accepted as a config file and reproduce the same
+	// configuration.
+	var got testConfig
+	fs = newTestFlagSet(&got)
+	fs.Parse(nil)
+	if err := ApplyConfig(fs, writeConfig(t, buf.String()), nil); err != nil {
+		t.Fatalf("ApplyConfig(PrintConfig() output): %v", err)
+	}
+	if !reflect.DeepEqual(got, c) {
+		t.Errorf("ApplyConfig(PrintConfig() output): want: %+v, got: %+v", c, got)
+	}
+
+	var values map[string]any
+	json.Unmarshal(buf.Bytes(), &values)
+	if _, ok := values[FlagConfig]; ok {
+		t.Errorf("PrintConfig(): output contains %q", FlagConfig)
+	}
+}
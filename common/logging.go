@@ -0,0 +1,54 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"flag"
+	"log/slog"
+	"os"
+
+	cs "github.com/icemarkom/certsync"
+)
+
+// LogFlags registers the logging flags.
+func LogFlags(cfg *cs.Config) {
+	FlagSetLogFlags(flag.CommandLine, cfg)
+}
+
+// FlagSetLogFlags is LogFlags for a specific flag set.
+func FlagSetLogFlags(fs *flag.FlagSet, cfg *cs.Config) {
+	fs.StringVar(&cfg.LogLevel, "log_level", cs.DefaultLogLevel, "Log level: debug, info, warn or error. Debug traces DNS validation of clients.")
+	fs.StringVar(&cfg.LogFormat, "log_format", cs.DefaultLogFormat, "Log format: text or json.")
+	fs.StringVar(&cfg.LogOutput, "log_output", cs.DefaultLogOutput, "Log output: stderr or syslog. Under systemd, journald collects either.")
+}
+
+// SetupLogging makes the logger configured in cfg the default, which the log
+// package then writes to as well.
+func SetupLogging(cfg *cs.Config) error {
+	logger, err := cs.NewLogger(cfg)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	return nil
+}
+
+// Fatal logs msg and args at error level, and exits.
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
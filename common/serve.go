@@ -0,0 +1,48 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	cs "github.com/icemarkom/certsync"
+)
+
+// Serve listens on addr and serves handler in the background, over HTTPS if
+// tlsConfig is not nil, with read and write timeouts of timeout. Only
+// listening errors are returned; the listener failing later is fatal, and
+// logged with name.
+func Serve(name, addr string, handler http.Handler, timeout time.Duration, tlsConfig *tls.Config) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s := &http.Server{Handler: handler, ReadTimeout: timeout, WriteTimeout: timeout, TLSConfig: tlsConfig}
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			err = s.ServeTLS(l, "", "")
+		} else {
+			err = s.Serve(l)
+		}
+		Fatal(name+" listener failed", cs.ErrAttr(err))
+	}()
+	return nil
+}
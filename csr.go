@@ -0,0 +1,137 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+const (
+	// PEMTypeCSR is the PEM block type of certificate signing requests.
+	PEMTypeCSR = "CERTIFICATE REQUEST"
+
+	// CSRPath is the server endpoint that signs certificate requests.
+	CSRPath = "/csr"
+)
+
+// ErrCSRNotAllowed is returned when a CSR asks for names the client is not
+// entitled to.
+var ErrCSRNotAllowed = errors.New("certificate request not allowed")
+
+// NewCSR returns a PEM encoded certificate request, signed by key, for the
+// client identity id.
+func NewCSR(key crypto.Signer, id Identity) ([]byte, error) {
+	req := &x509.CertificateRequest{}
+	switch id.Kind {
+	case IdentityDNS, IdentityCN:
+		req.Subject.CommonName = id.Value
+		req.DNSNames = []string{id.Value}
+	case IdentityIP:
+		ip := net.ParseIP(id.Value)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP identity %q", id.Value)
+		}
+		req.IPAddresses = []net.IP{ip}
+	case IdentityURI:
+		u, err := url.Parse(id.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid URI identity %q: %v", id.Value, err)
+		}
+		req.URIs = []*url.URL{u}
+	default:
+		return nil, fmt.Errorf("unknown identity kind %q", id.Kind)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, req, key)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create certificate request: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: PEMTypeCSR, Bytes: der}), nil
+}
+
+// ParseCSR parses a PEM encoded certificate request and checks its signature.
+func ParseCSR(data []byte) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != PEMTypeCSR {
+		return nil, fmt.Errorf("no %q PEM block found", PEMTypeCSR)
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse certificate request: %v", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid certificate request signature: %v", err)
+	}
+	return csr, nil
+}
+
+// CheckCSR verifies that csr only asks for the validated identity id, or for
+// the DNS name of a CN identity. Other names on the client certificate were
+// not validated, and are refused. All returned errors wrap ErrCSRNotAllowed.
+func CheckCSR(csr *x509.CertificateRequest, id Identity) error {
+	allowed := func(r Identity) bool {
+		return r == id || (id.Kind == IdentityCN && r == Identity{IdentityDNS, id.Value})
+	}
+	// CN is only a display name in issued certificates, and may repeat the
+	// validated name.
+	if cn := csr.Subject.CommonName; cn != "" && cn != id.Value {
+		return fmt.Errorf("%w: common name %q", ErrCSRNotAllowed, cn)
+	}
+	requested := Identities(&x509.Certificate{
+		DNSNames:    csr.DNSNames,
+		IPAddresses: csr.IPAddresses,
+		URIs:        csr.URIs,
+	}, []string{IdentityDNS, IdentityIP, IdentityURI})
+	if len(requested) == 0 {
+		return fmt.Errorf("%w: no subject alternative names", ErrCSRNotAllowed)
+	}
+	for _, r := range requested {
+		if !allowed(r) {
+			return fmt.Errorf("%w: %v is not the validated identity %v", ErrCSRNotAllowed, r, id)
+		}
+	}
+	return nil
+}
+
+// SignCSR issues a certificate for csr, for client authentication and, if
+// serverAuth is set, for server authentication as well. It returns the PEM
+// encoded certificate followed by the CA certificate.
+func (ca *CA) SignCSR(csr *x509.CertificateRequest, lifetime time.Duration, serverAuth bool) ([]byte, error) {
+	req := IssueRequest{
+		Subject:  pkix.Name{CommonName: csr.Subject.CommonName},
+		DNSNames: csr.DNSNames,
+		IPs:      csr.IPAddresses,
+		URIs:     csr.URIs,
+		Lifetime: lifetime,
+	}
+	if serverAuth {
+		req.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	}
+	certPEM, err := ca.Sign(req, csr.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return append(certPEM, ca.CertPEM()...), nil
+}
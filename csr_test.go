@@ -0,0 +1,157 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"net"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCheckCSR(t *testing.T) {
+	id := Identity{Kind: IdentityDNS, Value: "host.example.com"}
+
+	var tests = []struct {
+		desc    string
+		csr     *x509.CertificateRequest
+		id      Identity
+		wantErr bool
+	}{
+		{
+			desc: "validated identity",
+			csr:  &x509.CertificateRequest{Subject: pkix.Name{CommonName: "host.example.com"}, DNSNames: []string{"host.example.com"}},
+			id:   id,
+		},
+		{
+			desc: "CN identity",
+			csr:  &x509.CertificateRequest{DNSNames: []string{"host.example.com"}},
+			id:   Identity{Kind: IdentityCN, Value: "host.example.com"},
+		},
+		{
+			desc: "IP identity",
+			csr:  &x509.CertificateRequest{IPAddresses: []net.IP{net.ParseIP("10.0.0.1")}},
+			id:   Identity{Kind: IdentityIP, Value: "10.0.0.1"},
+		},
+		{
+			// alias.example.com may be on the client certificate, but it was
+			// not validated.
+			desc:    "unvalidated name",
+			csr:     &x509.CertificateRequest{DNSNames: []string{"host.example.com", "alias.example.com"}},
+			id:      id,
+			wantErr: true,
+		},
+		{
+			desc:    "unvalidated IP",
+			csr:     &x509.CertificateRequest{DNSNames: []string{"host.example.com"}, IPAddresses: []net.IP{net.ParseIP("10.0.0.1")}},
+			id:      id,
+			wantErr: true,
+		},
+		{
+			desc:    "foreign CN",
+			csr:     &x509.CertificateRequest{Subject: pkix.Name{CommonName: "other.example.com"}, DNSNames: []string{"host.example.com"}},
+			id:      id,
+			wantErr: true,
+		},
+		{
+			desc:    "validated identity missing",
+			csr:     &x509.CertificateRequest{DNSNames: []string{"alias.example.com"}},
+			id:      id,
+			wantErr: true,
+		},
+		{
+			desc:    "no names",
+			csr:     &x509.CertificateRequest{Subject: pkix.Name{CommonName: "host.example.com"}},
+			id:      id,
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		err := CheckCSR(tc.csr, tc.id)
+		if tc.wantErr != errors.Is(err, ErrCSRNotAllowed) || (!tc.wantErr && err != nil) {
+			t.Errorf("CheckCSR(%s): wantErr: %v, got: %v", tc.desc, tc.wantErr, err)
+		}
+	}
+}
+
+func leafExtKeyUsage(t *testing.T, chain []byte) []x509.ExtKeyUsage {
+	t.Helper()
+	block, _ := pem.Decode(chain)
+	if block == nil {
+		t.Fatalf("no PEM block in chain")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate(): %v", err)
+	}
+	return cert.ExtKeyUsage
+}
+
+func TestSignCSR(t *testing.T) {
+	ca, err := InitCA(filepath.Join(t.TempDir(), "ca"), pkix.Name{CommonName: "Test CA"}, KeyECDSAP256, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("InitCA(): %v", err)
+	}
+	id := Identity{Kind: IdentityDNS, Value: "host.example.com"}
+
+	key, err := GenerateKey(KeyEd25519)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %v", err)
+	}
+	csrPEM, err := NewCSR(key, id)
+	if err != nil {
+		t.Fatalf("NewCSR(): %v", err)
+	}
+	csr, err := ParseCSR(csrPEM)
+	if err != nil {
+		t.Fatalf("ParseCSR(): %v", err)
+	}
+	if err := CheckCSR(csr, id); err != nil {
+		t.Fatalf("CheckCSR(): %v", err)
+	}
+	chain, err := ca.SignCSR(csr, time.Hour, false)
+	if err != nil {
+		t.Fatalf("SignCSR(): %v", err)
+	}
+	if got := leafExtKeyUsage(t, chain); !slices.Equal(got, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}) {
+		t.Errorf("SignCSR(): want clientAuth only, got: %v", got)
+	}
+	keyPEM, _ := EncodeKey(key)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	if _, err := VerifyBundle(chain, keyPEM, VerifyOptions{Roots: roots, DNSName: "host.example.com"}); err != nil {
+		t.Errorf("VerifyBundle(signed chain): %v", err)
+	}
+
+	serverChain, err := ca.SignCSR(csr, time.Hour, true)
+	if err != nil {
+		t.Fatalf("SignCSR(serverAuth): %v", err)
+	}
+	if got := leafExtKeyUsage(t, serverChain); !slices.Contains(got, x509.ExtKeyUsageServerAuth) {
+		t.Errorf("SignCSR(serverAuth): want serverAuth, got: %v", got)
+	}
+
+	if _, err := ParseCSR([]byte("garbage")); err == nil {
+		t.Errorf("ParseCSR(garbage): want error, got nil")
+	}
+}
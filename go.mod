@@ -2,13 +2,25 @@ module github.com/icemarkom/certsync
 
 go 1.24.1
 
-require github.com/foxcpp/go-mockdns v1.1.0
+require (
+	github.com/foxcpp/go-mockdns v1.1.0
+	github.com/miekg/dns v1.1.63
+	github.com/prometheus/client_golang v1.23.2
+	github.com/prometheus/common v0.66.1
+	golang.org/x/crypto v0.41.0
+	golang.org/x/sync v0.13.0
+)
 
 require (
-	github.com/miekg/dns v1.1.63 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
+	github.com/prometheus/client_model v0.6.2 // indirect
+	github.com/prometheus/procfs v0.16.1 // indirect
+	go.yaml.in/yaml/v2 v2.4.2 // indirect
 	golang.org/x/mod v0.23.0 // indirect
-	golang.org/x/net v0.36.0 // indirect
-	golang.org/x/sync v0.11.0 // indirect
-	golang.org/x/sys v0.30.0 // indirect
+	golang.org/x/net v0.43.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
 	golang.org/x/tools v0.30.0 // indirect
+	google.golang.org/protobuf v1.36.8 // indirect
 )
@@ -0,0 +1,100 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Fingerprint returns the hex encoded SHA-256 digest of the concatenated data.
+func Fingerprint(data ...[]byte) string {
+	h := sha256.New()
+	for _, d := range data {
+		h.Write(d)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// FilesFingerprint returns the Fingerprint of the concatenated file contents.
+// Missing files are treated as empty.
+func FilesFingerprint(fileNames ...string) (string, error) {
+	var data [][]byte
+	for _, f := range fileNames {
+		d, err := os.ReadFile(f)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("cannot read %q: %v", f, err)
+		}
+		data = append(data, d)
+	}
+	return Fingerprint(data...), nil
+}
+
+// RunHook runs command with "/bin/sh -c", killing it if it does not complete
+// within timeout. The combined output is returned even on failure. env is
+// appended to the current environment.
+func RunHook(ctx context.Context, command string, timeout time.Duration, env ...string) ([]byte, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.WaitDelay = time.Second
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return out, fmt.Errorf("hook %q timed out after %v", command, timeout)
+	}
+	if err != nil {
+		return out, fmt.Errorf("hook %q failed: %v", command, err)
+	}
+	return out, nil
+}
+
+// HookState records, in FileName, the fingerprint of installed files whose
+// hooks failed. The files do not change again on the next fetch, so the
+// record is what makes later runs retry the hooks until they succeed.
+type HookState struct {
+	FileName string
+}
+
+// Pending reports whether the hooks failed for the files with fingerprint.
+func (s HookState) Pending(fingerprint string) bool {
+	data, err := os.ReadFile(s.FileName)
+	return err == nil && strings.TrimSpace(string(data)) == fingerprint
+}
+
+// Failed records that the hooks failed for the files with fingerprint.
+func (s HookState) Failed(fingerprint string) error {
+	return os.WriteFile(s.FileName, []byte(fingerprint+"\n"), 0600)
+}
+
+// Succeeded clears the record of failed hooks.
+func (s HookState) Succeeded() error {
+	if err := os.Remove(s.FileName); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilesFingerprint(t *testing.T) {
+	dir := t.TempDir()
+	cert := writeFile(t, dir, "cert.pem", "cert")
+	key := writeFile(t, dir, "key.pem", "key")
+
+	got, err := FilesFingerprint(cert, key)
+	if want := Fingerprint([]byte("cert"), []byte("key")); err != nil || got != want {
+		t.Errorf("FilesFingerprint(): want: %q, got: %q (err: %v)", want, got, err)
+	}
+	got, err = FilesFingerprint(filepath.Join(dir, "missing"))
+	if want := Fingerprint(nil); err != nil || got != want {
+		t.Errorf("FilesFingerprint(missing): want: %q, got: %q (err: %v)", want, got, err)
+	}
+}
+
+func TestRunHook(t *testing.T) {
+	var tests = []struct {
+		command string
+		want    string
+		wantErr bool
+	}{
+		{command: "echo $CERTSYNC_TEST", want: "hello"},
+		{command: "echo out; echo err >&2; exit 1", want: "out\nerr", wantErr: true},
+		{command: "sleep 10", wantErr: true},
+	}
+	for _, tc := range tests {
+		out, err := RunHook(context.Background(), tc.command, 500*time.Millisecond, "CERTSYNC_TEST=hello")
+		if got := strings.TrimSpace(string(out)); got != tc.want || (err != nil) != tc.wantErr {
+			t.Errorf("RunHook(%q): want: %q (wantErr: %v), got: %q (err: %v)", tc.command, tc.want, tc.wantErr, got, err)
+		}
+	}
+}
+
+func TestHookState(t *testing.T) {
+	s := HookState{FileName: filepath.Join(t.TempDir(), "newcert.pem.hooks_failed")}
+	if s.Pending("a") {
+		t.Errorf("Pending(): want false without a record")
+	}
+	if err := s.Failed("a"); err != nil {
+		t.Fatalf("Failed(): %v", err)
+	}
+	if !s.Pending("a") || s.Pending("b") {
+		t.Errorf("Pending(): want true only for the failed fingerprint")
+	}
+	for range 2 {
+		if err := s.Succeeded(); err != nil {
+			t.Errorf("Succeeded(): %v", err)
+		}
+	}
+	if s.Pending("a") {
+		t.Errorf("Pending(): want false after success")
+	}
+}
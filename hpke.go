@@ -0,0 +1,235 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// This file implements the single-shot base mode of HPKE (RFC 9180), with
+// the DHKEMs of the curves in crypto/ecdh, for wrapping keys. It is tested
+// against the RFC 9180 test vectors, and against crypto/hpke where the Go
+// version has it.
+
+// HPKE algorithm identifiers (RFC 9180, section 7).
+const (
+	hpkeKEMP256   uint16 = 0x0010
+	hpkeKEMP384   uint16 = 0x0011
+	hpkeKEMP521   uint16 = 0x0012
+	hpkeKEMX25519 uint16 = 0x0020
+
+	hpkeKDFSHA256 uint16 = 0x0001
+	hpkeKDFSHA384 uint16 = 0x0002
+	hpkeKDFSHA512 uint16 = 0x0003
+
+	hpkeAEADAES128GCM uint16 = 0x0001
+	hpkeAEADAES256GCM uint16 = 0x0002
+	hpkeAEADChaCha20  uint16 = 0x0003
+)
+
+const hpkeModeBase = 0x00
+
+// hpkeKEM returns the DHKEM identifier for curve, and the hash of its KDF.
+func hpkeKEM(curve ecdh.Curve) (uint16, func() hash.Hash, error) {
+	switch curve {
+	case ecdh.P256():
+		return hpkeKEMP256, sha256.New, nil
+	case ecdh.P384():
+		return hpkeKEMP384, sha512.New384, nil
+	case ecdh.P521():
+		return hpkeKEMP521, sha512.New, nil
+	case ecdh.X25519():
+		return hpkeKEMX25519, sha256.New, nil
+	}
+	return 0, nil, fmt.Errorf("unsupported curve %v", curve)
+}
+
+func hpkeKDF(id uint16) (func() hash.Hash, error) {
+	switch id {
+	case hpkeKDFSHA256:
+		return sha256.New, nil
+	case hpkeKDFSHA384:
+		return sha512.New384, nil
+	case hpkeKDFSHA512:
+		return sha512.New, nil
+	}
+	return nil, fmt.Errorf("unsupported HPKE KDF 0x%04x", id)
+}
+
+// hpkeAEAD returns the key size of the AEAD id, and its constructor.
+func hpkeAEAD(id uint16) (int, func(key []byte) (cipher.AEAD, error), error) {
+	gcm := func(key []byte) (cipher.AEAD, error) {
+		b, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(b)
+	}
+	switch id {
+	case hpkeAEADAES128GCM:
+		return 16, gcm, nil
+	case hpkeAEADAES256GCM:
+		return 32, gcm, nil
+	case hpkeAEADChaCha20:
+		return chacha20poly1305.KeySize, chacha20poly1305.New, nil
+	}
+	return 0, nil, fmt.Errorf("unsupported HPKE AEAD 0x%04x", id)
+}
+
+func labeledExtract(h func() hash.Hash, suiteID []byte, salt []byte, label string, ikm []byte) ([]byte, error) {
+	labeled := append([]byte("HPKE-v1"), suiteID...)
+	labeled = append(labeled, label...)
+	labeled = append(labeled, ikm...)
+	return hkdf.Extract(h, labeled, salt)
+}
+
+func labeledExpand(h func() hash.Hash, suiteID []byte, prk []byte, label string, info []byte, length int) ([]byte, error) {
+	labeled := binary.BigEndian.AppendUint16(nil, uint16(length))
+	labeled = append(labeled, "HPKE-v1"...)
+	labeled = append(labeled, suiteID...)
+	labeled = append(labeled, label...)
+	labeled = append(labeled, info...)
+	return hkdf.Expand(h, prk, string(labeled), length)
+}
+
+// hpkeSharedSecret derives the DHKEM shared secret from the DH output and
+// the encapsulated and recipient public keys.
+func hpkeSharedSecret(curve ecdh.Curve, dh, enc, pkR []byte) ([]byte, error) {
+	kemID, h, err := hpkeKEM(curve)
+	if err != nil {
+		return nil, err
+	}
+	suiteID := binary.BigEndian.AppendUint16([]byte("KEM"), kemID)
+	prk, err := labeledExtract(h, suiteID, nil, "eae_prk", dh)
+	if err != nil {
+		return nil, err
+	}
+	kemContext := append(append([]byte{}, enc...), pkR...)
+	return labeledExpand(h, suiteID, prk, "shared_secret", kemContext, h().Size())
+}
+
+// hpkeKeySchedule returns the AEAD of the base mode context, and its nonce
+// for the first message.
+func hpkeKeySchedule(kemID, kdfID, aeadID uint16, sharedSecret, info []byte) (cipher.AEAD, []byte, error) {
+	h, err := hpkeKDF(kdfID)
+	if err != nil {
+		return nil, nil, err
+	}
+	keySize, newAEAD, err := hpkeAEAD(aeadID)
+	if err != nil {
+		return nil, nil, err
+	}
+	suiteID := []byte("HPKE")
+	for _, id := range []uint16{kemID, kdfID, aeadID} {
+		suiteID = binary.BigEndian.AppendUint16(suiteID, id)
+	}
+	pskIDHash, err := labeledExtract(h, suiteID, nil, "psk_id_hash", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	infoHash, err := labeledExtract(h, suiteID, nil, "info_hash", info)
+	if err != nil {
+		return nil, nil, err
+	}
+	context := append([]byte{hpkeModeBase}, pskIDHash...)
+	context = append(context, infoHash...)
+	secret, err := labeledExtract(h, suiteID, sharedSecret, "secret", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := labeledExpand(h, suiteID, secret, "key", context, keySize)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce, err := labeledExpand(h, suiteID, secret, "base_nonce", context, aead.NonceSize())
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, nonce, nil
+}
+
+// hpkeSeal encrypts plaintext to pkR, and returns the encapsulated key
+// followed by the ciphertext.
+func hpkeSeal(pkR *ecdh.PublicKey, kdfID, aeadID uint16, info, plaintext []byte) ([]byte, error) {
+	kemID, _, err := hpkeKEM(pkR.Curve())
+	if err != nil {
+		return nil, err
+	}
+	skE, err := pkR.Curve().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	dh, err := skE.ECDH(pkR)
+	if err != nil {
+		return nil, err
+	}
+	enc := skE.PublicKey().Bytes()
+	sharedSecret, err := hpkeSharedSecret(pkR.Curve(), dh, enc, pkR.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	aead, nonce, err := hpkeKeySchedule(kemID, kdfID, aeadID, sharedSecret, info)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(enc, nonce, plaintext, nil), nil
+}
+
+// hpkeOpen decrypts the output of hpkeSeal with skR.
+func hpkeOpen(skR *ecdh.PrivateKey, kdfID, aeadID uint16, info, ciphertext []byte) ([]byte, error) {
+	kemID, _, err := hpkeKEM(skR.Curve())
+	if err != nil {
+		return nil, err
+	}
+	encLen := len(skR.PublicKey().Bytes())
+	if len(ciphertext) < encLen {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	enc, ct := ciphertext[:encLen], ciphertext[encLen:]
+	pkE, err := skR.Curve().NewPublicKey(enc)
+	if err != nil {
+		return nil, err
+	}
+	dh, err := skR.ECDH(pkE)
+	if err != nil {
+		return nil, err
+	}
+	sharedSecret, err := hpkeSharedSecret(skR.Curve(), dh, enc, skR.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	aead, nonce, err := hpkeKeySchedule(kemID, kdfID, aeadID, sharedSecret, info)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, nonce, ct, nil)
+}
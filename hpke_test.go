@@ -0,0 +1,193 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/sha3"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+)
+
+// hpkeCurves are the DHKEM curves by KEM identifier, and the size of their
+// private keys.
+var hpkeCurves = map[uint16]struct {
+	curve ecdh.Curve
+	nsk   int
+}{
+	hpkeKEMP256:   {ecdh.P256(), 32},
+	hpkeKEMP384:   {ecdh.P384(), 48},
+	hpkeKEMP521:   {ecdh.P521(), 66},
+	hpkeKEMX25519: {ecdh.X25519(), 32},
+}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("cannot decode %q: %v", s, err)
+	}
+	return b
+}
+
+// hpkeDeriveKeyPair implements DeriveKeyPair (RFC 9180, section 7.1.3), which
+// the test vectors derive their ephemeral keys with.
+func hpkeDeriveKeyPair(t *testing.T, kemID uint16, ikm []byte) *ecdh.PrivateKey {
+	t.Helper()
+	c := hpkeCurves[kemID]
+	_, h, err := hpkeKEM(c.curve)
+	if err != nil {
+		t.Fatalf("hpkeKEM(): %v", err)
+	}
+	suiteID := binary.BigEndian.AppendUint16([]byte("KEM"), kemID)
+	prk, err := labeledExtract(h, suiteID, nil, "dkp_prk", ikm)
+	if err != nil {
+		t.Fatalf("labeledExtract(): %v", err)
+	}
+	if kemID == hpkeKEMX25519 {
+		sk, err := labeledExpand(h, suiteID, prk, "sk", nil, c.nsk)
+		if err != nil {
+			t.Fatalf("labeledExpand(): %v", err)
+		}
+		k, err := c.curve.NewPrivateKey(sk)
+		if err != nil {
+			t.Fatalf("NewPrivateKey(): %v", err)
+		}
+		return k
+	}
+	for counter := range 256 {
+		sk, err := labeledExpand(h, suiteID, prk, "candidate", []byte{byte(counter)}, c.nsk)
+		if err != nil {
+			t.Fatalf("labeledExpand(): %v", err)
+		}
+		if kemID == hpkeKEMP521 {
+			sk[0] &= 0x01
+		}
+		// NewPrivateKey rejects zero and keys not below the group order.
+		if k, err := c.curve.NewPrivateKey(sk); err == nil {
+			return k
+		}
+	}
+	t.Fatalf("no key pair derived")
+	return nil
+}
+
+// readRandomInput reads a length byte, and that many bytes, from r.
+func readRandomInput(t *testing.T, r io.Reader) []byte {
+	t.Helper()
+	var n [1]byte
+	if _, err := r.Read(n[:]); err != nil {
+		t.Fatalf("cannot read: %v", err)
+	}
+	b := make([]byte, n[0])
+	if _, err := r.Read(b); err != nil {
+		t.Fatalf("cannot read: %v", err)
+	}
+	return b
+}
+
+// TestHPKEVectors checks the base mode against the RFC 9180 test vectors in
+// testdata/hpke_rfc9180.json, taken from the Go distribution
+// (src/crypto/hpke/testdata/rfc9180.json). Instead of the individual
+// encryptions, they carry a SHAKE128 digest of 1000 encryptions of inputs read
+// from SHAKE128. The RFC has no vectors for DHKEM(P-384) and HKDF-SHA384,
+// which are checked against crypto/hpke where it is available.
+func TestHPKEVectors(t *testing.T) {
+	data, err := os.ReadFile("testdata/hpke_rfc9180.json")
+	if err != nil {
+		t.Fatalf("cannot read test vectors: %v", err)
+	}
+	var vectors []struct {
+		KEM            uint16 `json:"kem_id"`
+		KDF            uint16 `json:"kdf_id"`
+		AEAD           uint16 `json:"aead_id"`
+		Info           string `json:"info"`
+		IKME           string `json:"ikmE"`
+		SKRm           string `json:"skRm"`
+		PKRm           string `json:"pkRm"`
+		Enc            string `json:"enc"`
+		AccEncryptions string `json:"encryptions_accumulated"`
+	}
+	if err := json.Unmarshal(data, &vectors); err != nil {
+		t.Fatalf("cannot parse test vectors: %v", err)
+	}
+	for _, v := range vectors {
+		t.Run(fmt.Sprintf("kem 0x%04x kdf 0x%04x aead 0x%04x", v.KEM, v.KDF, v.AEAD), func(t *testing.T) {
+			curve := hpkeCurves[v.KEM].curve
+			skR, err := curve.NewPrivateKey(mustDecodeHex(t, v.SKRm))
+			if err != nil {
+				t.Fatalf("NewPrivateKey(skRm): %v", err)
+			}
+			pkR := mustDecodeHex(t, v.PKRm)
+			if !bytes.Equal(skR.PublicKey().Bytes(), pkR) {
+				t.Fatalf("skRm does not match pkRm")
+			}
+			info := mustDecodeHex(t, v.Info)
+
+			skE := hpkeDeriveKeyPair(t, v.KEM, mustDecodeHex(t, v.IKME))
+			enc := skE.PublicKey().Bytes()
+			if want := mustDecodeHex(t, v.Enc); !bytes.Equal(enc, want) {
+				t.Fatalf("enc: want: %x, got: %x", want, enc)
+			}
+			dh, err := skE.ECDH(skR.PublicKey())
+			if err != nil {
+				t.Fatalf("ECDH(): %v", err)
+			}
+			sharedSecret, err := hpkeSharedSecret(curve, dh, enc, pkR)
+			if err != nil {
+				t.Fatalf("hpkeSharedSecret(): %v", err)
+			}
+			aead, baseNonce, err := hpkeKeySchedule(v.KEM, v.KDF, v.AEAD, sharedSecret, info)
+			if err != nil {
+				t.Fatalf("hpkeKeySchedule(): %v", err)
+			}
+
+			source, sink := sha3.NewSHAKE128(), sha3.NewSHAKE128()
+			var first, firstPlaintext []byte
+			for seq := range 1000 {
+				aad, plaintext := readRandomInput(t, source), readRandomInput(t, source)
+				// The nonce of message seq is the base nonce XOR seq.
+				nonce := bytes.Clone(baseNonce)
+				for i, s := len(nonce)-1, seq; s > 0; i, s = i-1, s>>8 {
+					nonce[i] ^= byte(s)
+				}
+				ct := aead.Seal(nil, nonce, plaintext, aad)
+				sink.Write(ct)
+				if seq == 0 {
+					first, firstPlaintext = aead.Seal(nil, nonce, plaintext, nil), plaintext
+				}
+			}
+			acc := make([]byte, 16)
+			sink.Read(acc)
+			if want := mustDecodeHex(t, v.AccEncryptions); !bytes.Equal(acc, want) {
+				t.Errorf("accumulated encryptions: want: %x, got: %x", want, acc)
+			}
+
+			// hpkeOpen must recover a message sealed with the vector's context.
+			got, err := hpkeOpen(skR, v.KDF, v.AEAD, info, append(enc, first...))
+			if err != nil || !bytes.Equal(got, firstPlaintext) {
+				t.Errorf("hpkeOpen(): want: %x, got: %x (err: %v)", firstPlaintext, got, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+)
+
+// Identity kinds, as used in the identity policy.
+const (
+	IdentityDNS = "dns" // DNS SANs.
+	IdentityIP  = "ip"  // IP address SANs.
+	IdentityURI = "uri" // URI SANs, e.g. SPIFFE IDs.
+	IdentityCN  = "cn"  // Subject CommonName.
+
+	DefaultIdentityPolicy = IdentityDNS + "," + IdentityCN
+)
+
+// Identity is a name a client certificate was issued for.
+type Identity struct {
+	Kind, Value string
+}
+
+func (id Identity) String() string {
+	return id.Kind + ":" + id.Value
+}
+
+// ParseIdentityPolicy parses a comma separated list of identity kinds, in
+// order of preference.
+func ParseIdentityPolicy(s string) ([]string, error) {
+	var policy []string
+	for _, k := range strings.Split(s, ",") {
+		k = strings.ToLower(strings.TrimSpace(k))
+		switch k {
+		case IdentityDNS, IdentityIP, IdentityURI, IdentityCN:
+			policy = append(policy, k)
+		default:
+			return nil, fmt.Errorf("unknown identity kind %q in policy %q", k, s)
+		}
+	}
+	return policy, nil
+}
+
+// Identities returns the identities in cert of the kinds listed in policy, in
+// policy order.
+func Identities(cert *x509.Certificate, policy []string) []Identity {
+	var ids []Identity
+	for _, kind := range policy {
+		switch kind {
+		case IdentityDNS:
+			for _, n := range cert.DNSNames {
+				ids = append(ids, Identity{Kind: kind, Value: n})
+			}
+		case IdentityIP:
+			for _, ip := range cert.IPAddresses {
+				ids = append(ids, Identity{Kind: kind, Value: ip.String()})
+			}
+		case IdentityURI:
+			for _, u := range cert.URIs {
+				ids = append(ids, Identity{Kind: kind, Value: u.String()})
+			}
+		case IdentityCN:
+			if cert.Subject.CommonName != "" {
+				ids = append(ids, Identity{Kind: kind, Value: cert.Subject.CommonName})
+			}
+		}
+	}
+	return ids
+}
+
+// ValidateIdentity checks the client address against the identities in cert
+// allowed by policy, as returned by ParseIdentityPolicy, and returns the
+// identity the client is known by. Names (DNS SANs and CN) are validated with
+// ValidateAddresses, IP SANs must equal the client address. URI SANs cannot be
+// checked against an address, and are only accepted when another identity
+// validates.
+//
+// The returned identity is the first in policy order that is acceptable.
+// Lookups are bounded by ctx, and validation steps are logged to logger. If no
+// identity validates, a definite mismatch of any identity is returned in
+// preference to lookup failures, so that the error only wraps ErrLookupFailed
+// when every identity failed for want of DNS.
+func ValidateIdentity(ctx context.Context, cfg *Config, logger *slog.Logger, policy []string, cert *x509.Certificate, ip net.IP) (Identity, error) {
+	ids := Identities(cert, policy)
+	if len(ids) == 0 {
+		return Identity{}, fmt.Errorf("certificate has no identity allowed by policy %q", strings.Join(policy, ","))
+	}
+
+	var mismatches, failures []error
+	winner := -1
+	for i, id := range ids {
+		if id.Kind == IdentityURI {
+			if winner < 0 {
+				winner = i
+			}
+			continue
+		}
+		if err := validateIdentity(ctx, cfg, logger, id, ip); err != nil {
+			logger.Debug("Identity did not validate", LogKeyIdentity, id.String(), ErrAttr(err))
+			if errors.Is(err, ErrLookupFailed) {
+				failures = append(failures, err)
+			} else {
+				mismatches = append(mismatches, err)
+			}
+			continue
+		}
+		if winner < 0 {
+			winner = i
+		}
+		return ids[winner], nil
+	}
+	if len(mismatches) > 0 {
+		return Identity{}, errors.Join(mismatches...)
+	}
+	if len(failures) > 0 {
+		return Identity{}, errors.Join(failures...)
+	}
+	return Identity{}, fmt.Errorf("certificate has no identity that can be validated against address %q", ip)
+}
+
+func validateIdentity(ctx context.Context, cfg *Config, logger *slog.Logger, id Identity, ip net.IP) error {
+	if id.Kind == IdentityIP {
+		if net.ParseIP(id.Value).Equal(ip) {
+			return nil
+		}
+		return fmt.Errorf("address %q does not match certificate IP %q", ip, id.Value)
+	}
+	return ValidateAddresses(ctx, cfg, logger, id.Value, ip)
+}
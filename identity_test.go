@@ -0,0 +1,131 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+)
+
+func TestParseIdentityPolicy(t *testing.T) {
+	var tests = []struct {
+		policy  string
+		want    int
+		wantErr bool
+	}{
+		{policy: DefaultIdentityPolicy, want: 2},
+		{policy: "URI, dns,ip ,cn", want: 4},
+		{policy: "dns,email", wantErr: true},
+		{policy: "", wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := ParseIdentityPolicy(tc.policy)
+		if len(got) != tc.want || (err != nil) != tc.wantErr {
+			t.Errorf("ParseIdentityPolicy(%q): want %d kinds (wantErr: %v), got: %q (err: %v)", tc.policy, tc.want, tc.wantErr, got, err)
+		}
+	}
+}
+
+func TestValidateIdentity(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://example.com/host/valid")
+	cert := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "mismatched.example.com"},
+		DNSNames:    []string{"invalid.example.com", "valid.example.com"},
+		IPAddresses: []net.IP{net.ParseIP("10.0.0.9")},
+		URIs:        []*url.URL{spiffe},
+	}
+
+	var tests = []struct {
+		policy  string
+		ip      net.IP
+		want    Identity
+		wantErr bool
+	}{
+		{
+			policy: "dns,cn",
+			ip:     net.ParseIP("10.0.0.1"),
+			want:   Identity{Kind: IdentityDNS, Value: "valid.example.com"},
+		},
+		{
+			// CN alone is the legacy behaviour.
+			policy:  "cn",
+			ip:      net.ParseIP("10.0.0.1"),
+			wantErr: true,
+		},
+		{
+			policy: "ip,dns",
+			ip:     net.ParseIP("10.0.0.9"),
+			want:   Identity{Kind: IdentityIP, Value: "10.0.0.9"},
+		},
+		{
+			policy: "uri,dns",
+			ip:     net.ParseIP("10.0.0.1"),
+			want:   Identity{Kind: IdentityURI, Value: "spiffe://example.com/host/valid"},
+		},
+		{
+			// A URI cannot be validated on its own.
+			policy:  "uri",
+			ip:      net.ParseIP("10.0.0.1"),
+			wantErr: true,
+		},
+		{
+			policy:  "dns,ip,cn",
+			ip:      net.ParseIP("10.0.0.3"),
+			wantErr: true,
+		},
+	}
+
+	cfg := setUp()
+	for _, tc := range tests {
+		policy, err := ParseIdentityPolicy(tc.policy)
+		if err != nil {
+			t.Fatalf("ParseIdentityPolicy(%q): %v", tc.policy, err)
+		}
+		got, err := ValidateIdentity(context.Background(), cfg, discardLogger, policy, cert, tc.ip)
+		if (err != nil) != tc.wantErr || (!tc.wantErr && got != tc.want) {
+			t.Errorf("ValidateIdentity(%q, %q): want: %v (wantErr: %v), got: %v (err: %v)", tc.policy, tc.ip, tc.want, tc.wantErr, got, err)
+		}
+	}
+
+	if _, err := ValidateIdentity(context.Background(), cfg, discardLogger, []string{IdentityDNS}, &x509.Certificate{Subject: pkix.Name{CommonName: "valid.example.com"}}, net.ParseIP("10.0.0.1")); err == nil {
+		t.Errorf("ValidateIdentity(no DNS SANs, %q): want error, got nil", "dns")
+	}
+}
+
+func TestValidateIdentityMismatchFirst(t *testing.T) {
+	cert := &x509.Certificate{
+		DNSNames:    []string{"valid.example.com"},
+		IPAddresses: []net.IP{net.ParseIP("10.0.0.9")},
+	}
+	cfg := setupBadResolver()
+	ip := net.ParseIP("10.0.0.1")
+
+	if _, err := ValidateIdentity(context.Background(), cfg, discardLogger, []string{IdentityDNS}, cert, ip); !errors.Is(err, ErrLookupFailed) {
+		t.Errorf("ValidateIdentity(%q): want ErrLookupFailed, got: %v", "dns", err)
+	}
+	// The IP SAN definitely does not match, whatever DNS would have said.
+	for _, policy := range [][]string{{IdentityDNS, IdentityIP}, {IdentityIP, IdentityDNS}} {
+		if _, err := ValidateIdentity(context.Background(), cfg, discardLogger, policy, cert, ip); err == nil || errors.Is(err, ErrLookupFailed) {
+			t.Errorf("ValidateIdentity(%q): want a mismatch without ErrLookupFailed, got: %v", policy, err)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Log formats and outputs.
+const (
+	LogFormatText   = "text"
+	LogFormatJSON   = "json"
+	LogOutputStderr = "stderr"
+	LogOutputSyslog = "syslog"
+
+	DefaultLogLevel  = "info"
+	DefaultLogFormat = LogFormatText
+	DefaultLogOutput = LogOutputStderr
+)
+
+// Log attribute keys shared by all components.
+const (
+	LogKeyClientCN = "client_cn"
+	LogKeyRemoteIP = "remote_ip"
+	LogKeyBundle   = "bundle"
+	LogKeyIdentity = "identity"
+	LogKeyHost     = "host"
+	LogKeyAddr     = "addr"
+	LogKeyFile     = "file"
+	LogKeyError    = "error"
+)
+
+// NewLogger returns the logger described by cfg.LogLevel, cfg.LogFormat and
+// cfg.LogOutput.
+func NewLogger(cfg *Config) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q: want debug, info, warn or error", cfg.LogLevel)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	var newHandler func(io.Writer, *slog.HandlerOptions) slog.Handler
+	switch strings.ToLower(cfg.LogFormat) {
+	case LogFormatText:
+		newHandler = func(w io.Writer, o *slog.HandlerOptions) slog.Handler { return slog.NewTextHandler(w, o) }
+	case LogFormatJSON:
+		newHandler = func(w io.Writer, o *slog.HandlerOptions) slog.Handler { return slog.NewJSONHandler(w, o) }
+	default:
+		return nil, fmt.Errorf("invalid log format %q: want %s or %s", cfg.LogFormat, LogFormatText, LogFormatJSON)
+	}
+
+	switch strings.ToLower(cfg.LogOutput) {
+	case LogOutputStderr:
+		return slog.New(newHandler(os.Stderr, opts)), nil
+	case LogOutputSyslog:
+		h, err := newSyslogHandler(cfg.BinaryName, newHandler, opts)
+		if err != nil {
+			return nil, fmt.Errorf("cannot connect to syslog: %v", err)
+		}
+		return slog.New(h), nil
+	}
+	return nil, fmt.Errorf("invalid log output %q: want %s or %s", cfg.LogOutput, LogOutputStderr, LogOutputSyslog)
+}
+
+// ErrAttr returns the attribute for err under LogKeyError.
+func ErrAttr(err error) slog.Attr {
+	return slog.Any(LogKeyError, err)
+}
@@ -0,0 +1,68 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestNewLogger(t *testing.T) {
+	var tests = []struct {
+		level, format, output string
+		wantErr               bool
+	}{
+		{level: "info", format: "text", output: "stderr"},
+		{level: "DEBUG", format: "json", output: "stderr"},
+		{level: "warn", format: "JSON", output: "Stderr"},
+		{level: "verbose", format: "text", output: "stderr", wantErr: true},
+		{level: "info", format: "xml", output: "stderr", wantErr: true},
+		{level: "info", format: "text", output: "file", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		cfg := NewConfig("test_binary", "test_version", "test_commit")
+		cfg.LogLevel, cfg.LogFormat, cfg.LogOutput = tc.level, tc.format, tc.output
+		_, err := NewLogger(cfg)
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("NewLogger(%q, %q, %q): want error: %v, got: %v", tc.level, tc.format, tc.output, tc.wantErr, err)
+		}
+	}
+}
+
+func TestValidateAddressesLogs(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	cfg := setUp()
+
+	if err := ValidateAddresses(context.Background(), cfg, logger.With(LogKeyClientCN, "valid.example.com"), "valid.example.com", net.ParseIP("10.0.0.1")); err != nil {
+		t.Fatalf("ValidateAddresses(): %v", err)
+	}
+	var last map[string]any
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &last); err != nil {
+		t.Fatalf("cannot parse log line %q: %v", lines[len(lines)-1], err)
+	}
+	if last[slog.MessageKey] != "Address validated" || last[LogKeyClientCN] != "valid.example.com" || last[LogKeyAddr] != "10.0.0.1" {
+		t.Errorf("ValidateAddresses(): want validation decision logged with client fields, got: %v", last)
+	}
+}
@@ -18,54 +18,222 @@ package certsync
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/netip"
 	"strings"
 )
 
-func validReverse(cfg *Config, ip net.IP, host string) bool {
-	addrList, err := cfg.Resolver.LookupAddr(context.Background(), ip.String())
-	if err != nil {
-		return false
+// ErrLookupFailed matches, with errors.Is, every DNSUnavailableError.
+var ErrLookupFailed = errors.New("validation failed due to lookup failure")
+
+// DNSUnavailableError is returned when a client cannot be validated because
+// the resolver failed or timed out, as opposed to answering that the client
+// address does not match its name.
+type DNSUnavailableError struct {
+	Name string
+	Err  error
+}
+
+func (e *DNSUnavailableError) Error() string {
+	return fmt.Sprintf("%v: lookup of %q: %v", ErrLookupFailed, e.Name, e.Err)
+}
+
+func (e *DNSUnavailableError) Unwrap() error {
+	return e.Err
+}
+
+func (e *DNSUnavailableError) Is(target error) bool {
+	return target == ErrLookupFailed
+}
+
+// isNotFound reports whether err is an answer that the name does not exist.
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// lookupContext returns the context of a single lookup, bounded by
+// cfg.DNSTimeout.
+func lookupContext(ctx context.Context, cfg *Config) (context.Context, context.CancelFunc) {
+	if cfg.DNSTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, cfg.DNSTimeout)
+}
+
+// validReverse returns nil if ip resolves back to host, and a
+// DNSUnavailableError if the resolver failed.
+func validReverse(ctx context.Context, cfg *Config, logger *slog.Logger, ip net.IP, host string) error {
+	ctx, cancel := lookupContext(ctx, cfg)
+	defer cancel()
+	addrList, err := cfg.Resolver.LookupAddr(ctx, ip.String())
+	if err != nil && !isNotFound(err) {
+		logger.Warn("Reverse lookup failed", LogKeyAddr, ip, ErrAttr(err))
+		return &DNSUnavailableError{Name: ip.String(), Err: err}
 	}
 	for _, a := range addrList {
 		if strings.TrimSuffix(a, ".") == host {
-			return true
+			return nil
 		}
 	}
-	return false
+	logger.Debug("Address does not resolve back to host", LogKeyAddr, ip, LogKeyHost, host, "names", addrList)
+	return fmt.Errorf("address %q does not resolve back to host %q", ip, host)
 }
 
-// ValidateAddresses ...
-func ValidateAddresses(cfg *Config, hostName string, hostAddr net.IP) error {
-	addrList, err := cfg.Resolver.LookupIPAddr(context.Background(), hostName)
+// ValidateAddresses checks that hostName resolves to hostAddr, and that
+// hostAddr resolves back to hostName. Each lookup is bounded by ctx and
+// cfg.DNSTimeout. If the resolver fails, the error is a
+// DNSUnavailableError. Lookups and their results are logged to logger at
+// debug level.
+func ValidateAddresses(ctx context.Context, cfg *Config, logger *slog.Logger, hostName string, hostAddr net.IP) error {
+	lctx, cancel := lookupContext(ctx, cfg)
+	addrList, err := cfg.Resolver.LookupIPAddr(lctx, hostName)
+	cancel()
+	if isNotFound(err) {
+		logger.Debug("Host not found", LogKeyHost, hostName)
+		return fmt.Errorf("host %q not found", hostName)
+	}
 	if err != nil {
-		return fmt.Errorf("validation failed due to lookup failure: %v", err)
+		logger.Warn("Forward lookup failed", LogKeyHost, hostName, ErrAttr(err))
+		return &DNSUnavailableError{Name: hostName, Err: err}
 	}
+	addrs := make([]string, len(addrList))
+	for i, addr := range addrList {
+		addrs[i] = addr.String()
+	}
+	logger.Debug("Forward lookup", LogKeyHost, hostName, "addrs", addrs)
 	for _, addr := range addrList {
-		if addr.IP.Equal(hostAddr) && validReverse(cfg, addr.IP, hostName) {
+		if !addr.IP.Equal(hostAddr) {
+			continue
+		}
+		err := validReverse(ctx, cfg, logger, addr.IP, hostName)
+		if err == nil {
+			logger.Debug("Address validated", LogKeyHost, hostName, LogKeyAddr, hostAddr)
 			return nil
 		}
+		if errors.Is(err, ErrLookupFailed) {
+			return err
+		}
 	}
 	return fmt.Errorf("address %q is not valid for host %q", hostAddr, hostName)
 }
 
-// IPFromRequest ...
-func IPFromRequest(r *http.Request) (net.IP, error) {
-	if r == nil {
-		return nil, fmt.Errorf("requestor host:port is empty")
+// CheckHostName verifies that host is in DNS and that at least one of its
+// addresses maps back to it, i.e. that a client with this name would pass
+// ValidateAddresses from one of its addresses.
+func CheckHostName(cfg *Config, host string) error {
+	ctx, cancel := lookupContext(context.Background(), cfg)
+	addrs, err := cfg.Resolver.LookupHost(ctx, host)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("host %q must be in DNS: %v", host, err)
+	}
+	for _, a := range addrs {
+		if ip := net.ParseIP(a); ip != nil && validReverse(context.Background(), cfg, slog.Default(), ip, host) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("none of the addresses %q of host %q resolve back to it", addrs, host)
+}
+
+// CheckResolver verifies that the resolver answers, by looking up the server's
+// own name. A negative answer counts as an answer. A CachingResolver is
+// bypassed, so that cached answers do not hide a resolver that went away.
+func CheckResolver(ctx context.Context, cfg *Config) error {
+	resolver := cfg.Resolver
+	if c, ok := resolver.(*CachingResolver); ok {
+		resolver = c.Upstream()
 	}
-	if r.Header.Get(headerXFF) != "" {
-		ip := net.ParseIP(strings.Split(r.Header.Get(headerXFF), " ")[0])
-		if ip != nil {
-			return ip, nil
+	_, err := resolver.LookupHost(ctx, cfg.HostName)
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("resolver unavailable: %v", err)
+	}
+	return nil
+}
+
+// ParseTrustedProxies parses a list of CIDR prefixes or single addresses, such
+// as trusted proxies or PROXY protocol upstreams.
+func ParseTrustedProxies(list []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			a, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address or prefix %q: %v", s, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(a.Unmap(), a.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address or prefix %q: %v", s, err)
 		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+func trusted(prefixes []netip.Prefix, a netip.Addr) bool {
+	a = a.Unmap()
+	for _, p := range prefixes {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseHop(s string) (netip.Addr, bool) {
+	if a, err := netip.ParseAddr(s); err == nil {
+		return a.Unmap(), true
+	}
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	return netip.Addr{}, false
+}
+
+// IPFromRequest returns the address of the requestor. X-Forwarded-For is only
+// honored when the connection comes from one of proxies, as returned by
+// ParseTrustedProxies, in which case the right-most hop that is not a trusted
+// proxy is used.
+func IPFromRequest(proxies []netip.Prefix, r *http.Request) (net.IP, error) {
+	if r == nil {
+		return nil, fmt.Errorf("requestor host:port is empty")
 	}
 	h, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
 		return nil, fmt.Errorf("invalid requestor host:port combination: %v", err)
 	}
-	ip := net.ParseIP(h)
-	return ip, nil
+	remote, ok := parseHop(h)
+	if !ok {
+		return nil, fmt.Errorf("invalid requestor address %q", h)
+	}
+
+	if !trusted(proxies, remote) {
+		return net.IP(remote.AsSlice()), nil
+	}
+
+	var hops []string
+	for _, v := range r.Header.Values(headerXFF) {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		a, ok := parseHop(strings.TrimSpace(hops[i]))
+		if !ok {
+			// Anything left of a malformed hop cannot be trusted; fall back
+			// to the last trusted proxy.
+			break
+		}
+		client = a
+		if !trusted(proxies, a) {
+			break
+		}
+	}
+	return net.IP(client.AsSlice()), nil
 }
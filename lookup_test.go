@@ -17,10 +17,12 @@
 package certsync
 
 import (
+	"context"
 	"errors"
 	"net"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/foxcpp/go-mockdns"
 	// "github.com/icemarkom/certsync"
@@ -58,7 +60,7 @@ func setupBadResolver() *Config {
 	cfg := NewConfig("test_binary", "test_version", "test_commit")
 	cfg.Resolver = &mockdns.Resolver{
 		Zones: map[string]mockdns.Zone{
-			"valid.example.com": {
+			"valid.example.com.": {
 				Err: errors.New("error"),
 			},
 		},
@@ -119,6 +121,17 @@ func TestIPFromRequest(t *testing.T) {
 			want:    net.ParseIP("10.0.0.1"),
 			wantErr: false,
 		},
+		{
+			// XFF from an untrusted client is ignored.
+			r: &http.Request{
+				RemoteAddr: "10.0.0.6:5000",
+				Header: http.Header{
+					headerXFF: {"10.0.0.1"},
+				},
+			},
+			want:    net.ParseIP("10.0.0.6"),
+			wantErr: false,
+		},
 		{
 			r: &http.Request{
 				RemoteAddr: "10.0.0.5:5000",
@@ -130,13 +143,47 @@ func TestIPFromRequest(t *testing.T) {
 			wantErr: false,
 		},
 		{
+			// Right-most untrusted hop wins, across header lines.
 			r: &http.Request{
 				RemoteAddr: "10.0.0.5:5000",
 				Header: http.Header{
 					headerXFF: {"10.0.0.1", "10.0.0.2", "10.0.0.3"},
 				},
 			},
-			want:    net.ParseIP("10.0.0.1"),
+			want:    net.ParseIP("10.0.0.3"),
+			wantErr: false,
+		},
+		{
+			// Comma separated, with trusted proxies in the chain.
+			r: &http.Request{
+				RemoteAddr: "10.0.0.5:5000",
+				Header: http.Header{
+					headerXFF: {"10.0.0.1, 10.0.0.2,192.168.1.1, 192.168.1.2"},
+				},
+			},
+			want:    net.ParseIP("10.0.0.2"),
+			wantErr: false,
+		},
+		{
+			// Spoofed left-most entry is not used.
+			r: &http.Request{
+				RemoteAddr: "[2001:db8::5]:5000",
+				Header: http.Header{
+					headerXFF: {"10.0.0.1, [2001:db8::1]:1234"},
+				},
+			},
+			want:    net.ParseIP("2001:db8::1"),
+			wantErr: false,
+		},
+		{
+			// All hops trusted: the left-most one is the client.
+			r: &http.Request{
+				RemoteAddr: "10.0.0.5:5000",
+				Header: http.Header{
+					headerXFF: {"192.168.1.1, 192.168.1.2"},
+				},
+			},
+			want:    net.ParseIP("192.168.1.1"),
 			wantErr: false,
 		},
 		{
@@ -159,14 +206,47 @@ func TestIPFromRequest(t *testing.T) {
 			want:    net.ParseIP("10.0.0.5"),
 			wantErr: false,
 		},
+		{
+			// Nothing left of a malformed hop is used.
+			r: &http.Request{
+				RemoteAddr: "10.0.0.5:5000",
+				Header: http.Header{
+					headerXFF: {"10.0.0.1, a, 192.168.1.1"},
+				},
+			},
+			want:    net.ParseIP("192.168.1.1"),
+			wantErr: false,
+		},
 	}
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.5", "192.168.1.0/24", "2001:db8::5/128"})
+	if err != nil {
+		t.Fatalf("ParseTrustedProxies(): %v", err)
+	}
+
 	for _, tc := range tests {
-		got, err := IPFromRequest(tc.r)
+		got, err := IPFromRequest(proxies, tc.r)
 		if !got.Equal(tc.want) || (err == nil && tc.wantErr) {
 			t.Errorf("IPFromRequest(%q [XFF: %q]): want: %v (got: %v), wantErr: %v (gotErr: %v)", tc.r.RemoteAddr, tc.r.Header.Get(headerXFF), tc.want, got, tc.wantErr, err != nil)
 		}
 	}
+}
 
+func TestParseTrustedProxies(t *testing.T) {
+	var tests = []struct {
+		list    []string
+		wantErr bool
+	}{
+		{list: nil},
+		{list: []string{"10.0.0.1", "10.0.0.0/8", "2001:db8::/32", "::ffff:10.0.0.1"}},
+		{list: []string{"10.0.0.0/33"}, wantErr: true},
+		{list: []string{"example.com"}, wantErr: true},
+	}
+	for _, tc := range tests {
+		_, err := ParseTrustedProxies(tc.list)
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("ParseTrustedProxies(%q): wantErr: %v, got: %v", tc.list, tc.wantErr, err)
+		}
+	}
 }
 
 func TestValidReverse(t *testing.T) {
@@ -210,7 +290,7 @@ func TestValidReverse(t *testing.T) {
 	cfg := setUp()
 
 	for _, tc := range tests {
-		got := validReverse(cfg, tc.ip, tc.host)
+		got := validReverse(context.Background(), cfg, discardLogger, tc.ip, tc.host) == nil
 		if got != tc.want {
 			t.Errorf("validReverse(%q, %q): want: %v, got: %v", tc.ip, tc.host, tc.want, got)
 		}
@@ -253,15 +333,144 @@ func TestValidateAddresses(t *testing.T) {
 	cfg := setUp()
 
 	for _, tc := range tests {
-		if gotErr := ValidateAddresses(cfg, tc.host, tc.ip) != nil; gotErr != tc.wantErr {
+		if gotErr := ValidateAddresses(context.Background(), cfg, discardLogger, tc.host, tc.ip) != nil; gotErr != tc.wantErr {
 			t.Errorf("ValidateAddresses(%q, %q): want: %v, got: %v", tc.host, tc.ip, tc.wantErr, gotErr)
 		}
 	}
 
 	// Special case, when the resolver errors out.
 	cfg = setupBadResolver()
-	if gotErr := ValidateAddresses(cfg, "valid.example.com", net.ParseIP("10.0.0.1")) != nil; !gotErr {
-		t.Errorf("[resolver error case] ValidateAddresses(%q, %q): want: %v, got: %v", "valid.example.com", "10.0.0.1", true, gotErr)
+	if err := ValidateAddresses(context.Background(), cfg, discardLogger, "valid.example.com", net.ParseIP("10.0.0.1")); !errors.Is(err, ErrLookupFailed) {
+		t.Errorf("[resolver error case] ValidateAddresses(%q, %q): want ErrLookupFailed, got: %v", "valid.example.com", "10.0.0.1", err)
 	}
 
 }
+
+// hungResolver never answers before the lookup context is done.
+type hungResolver struct{}
+
+func (hungResolver) LookupAddr(ctx context.Context, _ string) ([]string, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (hungResolver) LookupIPAddr(ctx context.Context, _ string) ([]net.IPAddr, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (hungResolver) LookupHost(ctx context.Context, _ string) ([]string, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestValidateAddressesUnavailable(t *testing.T) {
+	reverseFails := NewConfig("test_binary", "test_version", "test_commit")
+	reverseFails.Resolver = &mockdns.Resolver{
+		Zones: map[string]mockdns.Zone{
+			"valid.example.com.": {
+				A: []string{"10.0.0.1"},
+			},
+			"1.0.0.10.in-addr.arpa.": {
+				Err: errors.New("error"),
+			},
+		},
+	}
+	hung := NewConfig("test_binary", "test_version", "test_commit")
+	hung.Resolver = hungResolver{}
+	hung.DNSTimeout = 10 * time.Millisecond
+	// Without a timeout, only the request context ends the lookup.
+	unbounded := NewConfig("test_binary", "test_version", "test_commit")
+	unbounded.Resolver = hungResolver{}
+	unbounded.DNSTimeout = 0
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var tests = []struct {
+		name            string
+		ctx             context.Context
+		cfg             *Config
+		host            string
+		ip              net.IP
+		wantUnavailable bool
+	}{
+		{name: "not found", ctx: context.Background(), cfg: setUp(), host: "invalid.example.com", ip: net.ParseIP("10.0.0.1"), wantUnavailable: false},
+		{name: "mismatch", ctx: context.Background(), cfg: setUp(), host: "mismatched.example.com", ip: net.ParseIP("10.0.0.2"), wantUnavailable: false},
+		{name: "forward error", ctx: context.Background(), cfg: setupBadResolver(), host: "valid.example.com", ip: net.ParseIP("10.0.0.1"), wantUnavailable: true},
+		{name: "reverse error", ctx: context.Background(), cfg: reverseFails, host: "valid.example.com", ip: net.ParseIP("10.0.0.1"), wantUnavailable: true},
+		{name: "timeout", ctx: context.Background(), cfg: hung, host: "valid.example.com", ip: net.ParseIP("10.0.0.1"), wantUnavailable: true},
+		{name: "canceled", ctx: canceled, cfg: unbounded, host: "valid.example.com", ip: net.ParseIP("10.0.0.1"), wantUnavailable: true},
+	}
+
+	for _, tc := range tests {
+		err := ValidateAddresses(tc.ctx, tc.cfg, discardLogger, tc.host, tc.ip)
+		if err == nil {
+			t.Errorf("[%s] ValidateAddresses(%q, %q): want error, got nil", tc.name, tc.host, tc.ip)
+			continue
+		}
+		var dnsErr *DNSUnavailableError
+		if got := errors.As(err, &dnsErr); got != tc.wantUnavailable || errors.Is(err, ErrLookupFailed) != tc.wantUnavailable {
+			t.Errorf("[%s] ValidateAddresses(%q, %q): want DNS unavailable: %v, got: %v", tc.name, tc.host, tc.ip, tc.wantUnavailable, err)
+		}
+	}
+
+	// The timeout applies to each lookup, and is reported as such.
+	if err := ValidateAddresses(context.Background(), hung, discardLogger, "valid.example.com", net.ParseIP("10.0.0.1")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("[timeout] ValidateAddresses(): want context.DeadlineExceeded, got: %v", err)
+	}
+}
+
+func TestCheckHostName(t *testing.T) {
+	var tests = []struct {
+		host    string
+		wantErr bool
+	}{
+		{host: "valid.example.com", wantErr: false},
+		{host: "mismatched.example.com", wantErr: true},
+		{host: "invalid.example.com", wantErr: true},
+	}
+
+	cfg := setUp()
+
+	for _, tc := range tests {
+		if gotErr := CheckHostName(cfg, tc.host) != nil; gotErr != tc.wantErr {
+			t.Errorf("CheckHostName(%q): want: %v, got: %v", tc.host, tc.wantErr, gotErr)
+		}
+	}
+}
+
+func TestCheckResolver(t *testing.T) {
+	var tests = []struct {
+		name    string
+		cfg     *Config
+		host    string
+		wantErr bool
+	}{
+		{name: "answer", cfg: setUp(), host: "valid.example.com", wantErr: false},
+		{name: "not found", cfg: setUp(), host: "invalid.example.com", wantErr: false},
+		{name: "resolver error", cfg: setupBadResolver(), host: "valid.example.com", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		tc.cfg.HostName = tc.host
+		if gotErr := CheckResolver(context.Background(), tc.cfg) != nil; gotErr != tc.wantErr {
+			t.Errorf("[%s] CheckResolver(%q): want error: %v, got: %v", tc.name, tc.host, tc.wantErr, gotErr)
+		}
+	}
+
+	// A cached answer does not hide a resolver that went away.
+	cfg := setUp()
+	upstream := cfg.Resolver.(*mockdns.Resolver)
+	cfg.Resolver = NewCachingResolver(upstream, 10, time.Hour, time.Hour, time.Minute)
+	cfg.HostName = "valid.example.com"
+	if _, err := cfg.Resolver.LookupHost(context.Background(), cfg.HostName); err != nil {
+		t.Fatalf("[cached] LookupHost(): %v", err)
+	}
+	upstream.Zones["valid.example.com."] = mockdns.Zone{Err: errors.New("error")}
+	if _, err := cfg.Resolver.LookupHost(context.Background(), cfg.HostName); err != nil {
+		t.Fatalf("[cached] LookupHost(): want cached answer, got: %v", err)
+	}
+	if err := CheckResolver(context.Background(), cfg); err == nil {
+		t.Errorf("[cached] CheckResolver(): want error from upstream, got nil")
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+)
+
+// ParsePEM returns all PEM blocks found in data.
+func ParsePEM(data []byte) ([]*pem.Block, error) {
+	var (
+		pemList []*pem.Block
+		err     error
+	)
+
+	for {
+		block, rest := pem.Decode(data)
+		if block == nil {
+			break
+		}
+		pemList = append(pemList, block)
+		data = rest
+		if len(rest) == 0 {
+			break
+		}
+	}
+	if len(pemList) == 0 {
+		err = fmt.Errorf("no PEM blocks found")
+	}
+	return pemList, err
+}
+
+// EncodePEM returns the PEM encoding of all blocks.
+func EncodePEM(blocks []*pem.Block) []byte {
+	var buf bytes.Buffer
+	for _, block := range blocks {
+		buf.Write(pem.EncodeToMemory(block))
+	}
+	return buf.Bytes()
+}
+
+// SplitBundle separates PEM data into certificates and private keys, in the
+// form they are installed on clients. It also returns the number of ignored
+// blocks of other types.
+func SplitBundle(data []byte) (certPEM, keyPEM []byte, ignored int, err error) {
+	var certs, keys []*pem.Block
+
+	pemList, err := ParsePEM(data)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("cannot parse PEM data: %v", err)
+	}
+	for _, block := range pemList {
+		if block.Type == PEMTypeCertificate {
+			certs = append(certs, block)
+			continue
+		}
+		if block.Type == PEMTypePrivateKey {
+			keys = append(keys, block)
+			continue
+		}
+		ignored++
+	}
+	return EncodePEM(certs), EncodePEM(keys), ignored, nil
+}
+
+// BundleFingerprint returns the Fingerprint of a bundle as installed on
+// clients, i.e. of its certificates followed by its private keys. It matches
+// FilesFingerprint of the installed certificate and key files.
+func BundleFingerprint(data []byte) (string, error) {
+	certPEM, keyPEM, _, err := SplitBundle(data)
+	if err != nil {
+		return "", err
+	}
+	return Fingerprint(certPEM, keyPEM), nil
+}
+
+// ReadPrivateKey reads a PKCS#8 PEM encoded private key.
+func ReadPrivateKey(fileName string) (crypto.Signer, error) {
+	block, err := readPEMBlock(fileName, PEMTypePrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse key file %q: %v", fileName, err)
+	}
+	key, ok := k.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("key in %q cannot sign", fileName)
+	}
+	return key, nil
+}
+
+func readPEMBlock(fileName, pemType string) (*pem.Block, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read key file %q: %v", fileName, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != pemType {
+		return nil, fmt.Errorf("no %q PEM block in %q", pemType, fileName)
+	}
+	return block, nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSplitBundle(t *testing.T) {
+	_, leaf := newTestChain(t, "host.example.com")
+	other := []byte("-----BEGIN EC PARAMETERS-----\nBggqhkjOPQMBBw==\n-----END EC PARAMETERS-----\n")
+
+	data := bytes.Join([][]byte{other, leaf.keyPEM, []byte("junk\n"), leaf.certPEM}, nil)
+	certPEM, keyPEM, ignored, err := SplitBundle(data)
+	if err != nil {
+		t.Fatalf("SplitBundle(): %v", err)
+	}
+	if !bytes.Equal(certPEM, leaf.certPEM) || !bytes.Equal(keyPEM, leaf.keyPEM) || ignored != 1 {
+		t.Errorf("SplitBundle(): want cert, key and 1 ignored block, got: %q, %q, %d", certPEM, keyPEM, ignored)
+	}
+
+	if _, _, _, err := SplitBundle([]byte("no pem here")); err == nil {
+		t.Errorf("SplitBundle(no PEM): want error, got nil")
+	}
+}
+
+func TestBundleFingerprint(t *testing.T) {
+	dir := t.TempDir()
+	_, leaf := newTestChain(t, "host.example.com")
+
+	got, err := BundleFingerprint(append(append([]byte{}, leaf.keyPEM...), leaf.certPEM...))
+	if err != nil {
+		t.Fatalf("BundleFingerprint(): %v", err)
+	}
+	want, _ := FilesFingerprint(writeFile(t, dir, "cert.pem", string(leaf.certPEM)), writeFile(t, dir, "key.pem", string(leaf.keyPEM)))
+	if got != want {
+		t.Errorf("BundleFingerprint(): want installed files fingerprint %q, got: %q", want, got)
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+const pinPrefix = "sha256/"
+
+// SPKIPin returns the base64 encoded SHA-256 digest of the certificate's
+// SubjectPublicKeyInfo, the same value as:
+//
+//	openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// VerifyPins returns a tls.Config.VerifyPeerCertificate callback that requires
+// at least one certificate in a verified chain to match one of the pins. Pins
+// may carry an optional "sha256/" prefix.
+func VerifyPins(pins []string) func([][]byte, [][]*x509.Certificate) error {
+	want := make(map[string]bool, len(pins))
+	for _, p := range pins {
+		want[strings.TrimPrefix(p, pinPrefix)] = true
+	}
+	return func(_ [][]byte, chains [][]*x509.Certificate) error {
+		for _, chain := range chains {
+			for _, c := range chain {
+				if want[SPKIPin(c)] {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("server certificate chain does not match any pinned public key")
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"crypto/x509"
+	"testing"
+)
+
+func TestVerifyPins(t *testing.T) {
+	ca, leaf := newTestChain(t, "server.example.com")
+	_, other := newTestChain(t, "server.example.com")
+	chains := [][]*x509.Certificate{{leaf.cert, ca.cert}}
+
+	var tests = []struct {
+		desc    string
+		pins    []string
+		wantErr bool
+	}{
+		{desc: "leaf", pins: []string{SPKIPin(leaf.cert)}},
+		{desc: "CA with prefix", pins: []string{"sha256/" + SPKIPin(ca.cert)}},
+		{desc: "one of many", pins: []string{SPKIPin(other.cert), SPKIPin(leaf.cert)}},
+		{desc: "no match", pins: []string{SPKIPin(other.cert)}, wantErr: true},
+		{desc: "no pins", wantErr: true},
+	}
+	for _, tc := range tests {
+		err := VerifyPins(tc.pins)(nil, chains)
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("VerifyPins(%s): wantErr: %v, got: %v", tc.desc, tc.wantErr, err)
+		}
+	}
+}
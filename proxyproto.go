@@ -0,0 +1,214 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	proxyV1Prefix = "PROXY "
+	proxyV1MaxLen = 107
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyListener accepts connections carrying a PROXY protocol (v1 or v2)
+// header. Connections from Upstreams must start with a header, and their
+// RemoteAddr reports the address from it. Other connections are passed
+// through unchanged.
+type ProxyListener struct {
+	net.Listener
+	Upstreams []netip.Prefix
+	// Timeout limits how long reading the header may take.
+	Timeout time.Duration
+}
+
+// NewProxyListener wraps l to accept PROXY protocol headers from upstreams.
+func NewProxyListener(l net.Listener, upstreams []netip.Prefix, timeout time.Duration) *ProxyListener {
+	return &ProxyListener{Listener: l, Upstreams: upstreams, Timeout: timeout}
+}
+
+// Accept implements net.Listener. The header is read lazily, on first use of
+// the connection, so a slow upstream cannot block the accept loop.
+func (l *ProxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	ap, err := netip.ParseAddrPort(c.RemoteAddr().String())
+	if err != nil || !trusted(l.Upstreams, ap.Addr()) {
+		return c, nil
+	}
+	return &proxyConn{Conn: c, r: bufio.NewReader(c), timeout: l.Timeout}, nil
+}
+
+type proxyConn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once       sync.Once
+	err        error
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+			defer c.Conn.SetReadDeadline(time.Time{})
+		}
+		c.remoteAddr, c.localAddr, c.err = readProxyHeader(c.r)
+		if c.err != nil {
+			c.err = fmt.Errorf("invalid PROXY protocol header from %v: %v", c.Conn.RemoteAddr(), c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if c.init(); c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.init(); c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.init(); c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+// readProxyHeader reads a v1 or v2 header. Nil addresses are returned for
+// headers that do not carry them (v1 UNKNOWN, v2 LOCAL or unsupported
+// families).
+func readProxyHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	peek, err := r.Peek(len(proxyV2Signature))
+	if err != nil && len(peek) < len(proxyV1Prefix) {
+		return nil, nil, err
+	}
+	if bytes.Equal(peek, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if bytes.HasPrefix(peek, []byte(proxyV1Prefix)) {
+		return readProxyV1(r)
+	}
+	return nil, nil, fmt.Errorf("missing header")
+}
+
+func readProxyV1(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, fmt.Errorf("v1 header too long or not terminated")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("malformed v1 header %q", strings.TrimSpace(string(line)))
+	}
+	srcAddr, err1 := parseV1Addr(fields[2], fields[4])
+	dstAddr, err2 := parseV1Addr(fields[3], fields[5])
+	if err1 != nil || err2 != nil {
+		return nil, nil, fmt.Errorf("malformed v1 addresses %q", strings.TrimSpace(string(line)))
+	}
+	return srcAddr, dstAddr, nil
+}
+
+func parseV1Addr(ip, port string) (net.Addr, error) {
+	a, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(a, uint16(p))), nil
+}
+
+func readProxyV2(r *bufio.Reader) (src, dst net.Addr, err error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, nil, err
+	}
+	verCmd, family := hdr[12], hdr[13]
+	if verCmd>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported v2 version %d", verCmd>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	switch verCmd & 0x0f {
+	case 0x0: // LOCAL
+		return nil, nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, nil, fmt.Errorf("unsupported v2 command %d", verCmd&0x0f)
+	}
+
+	var ipLen int
+	switch family >> 4 {
+	case 0x1:
+		ipLen = 4
+	case 0x2:
+		ipLen = 16
+	default:
+		return nil, nil, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, nil, fmt.Errorf("v2 address block too short")
+	}
+	srcIP, _ := netip.AddrFromSlice(body[:ipLen])
+	dstIP, _ := netip.AddrFromSlice(body[ipLen : 2*ipLen])
+	srcPort := binary.BigEndian.Uint16(body[2*ipLen:])
+	dstPort := binary.BigEndian.Uint16(body[2*ipLen+2:])
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(srcIP, srcPort)),
+		net.TCPAddrFromAddrPort(netip.AddrPortFrom(dstIP, dstPort)), nil
+}
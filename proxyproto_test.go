@@ -0,0 +1,102 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func proxyV2Header(cmd, family byte, addrs []byte) []byte {
+	var b bytes.Buffer
+	b.Write(proxyV2Signature)
+	b.WriteByte(0x20 | cmd)
+	b.WriteByte(family)
+	binary.Write(&b, binary.BigEndian, uint16(len(addrs)))
+	b.Write(addrs)
+	return b.Bytes()
+}
+
+func TestProxyListener(t *testing.T) {
+	v4 := append(append(net.ParseIP("192.0.2.1").To4(), net.ParseIP("192.0.2.2").To4()...), 0x30, 0x39, 0x01, 0xbb)
+	v6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0x30, 0x39, 0x01, 0xbb)
+	// A TLV after the addresses must be skipped.
+	v6 = append(v6, 0x04, 0x00, 0x01, 0xff)
+
+	var tests = []struct {
+		desc     string
+		upstream string
+		header   []byte
+		want     string
+		wantErr  bool
+	}{
+		{desc: "v1 TCP4", upstream: "127.0.0.0/8", header: []byte("PROXY TCP4 192.0.2.1 192.0.2.2 12345 443\r\n"), want: "192.0.2.1:12345"},
+		{desc: "v1 TCP6", upstream: "127.0.0.0/8", header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 12345 443\r\n"), want: "[2001:db8::1]:12345"},
+		{desc: "v1 UNKNOWN", upstream: "127.0.0.0/8", header: []byte("PROXY UNKNOWN\r\n"), want: "127.0.0.1"},
+		{desc: "v2 TCP4", upstream: "127.0.0.0/8", header: proxyV2Header(0x1, 0x11, v4), want: "192.0.2.1:12345"},
+		{desc: "v2 TCP6 with TLV", upstream: "127.0.0.0/8", header: proxyV2Header(0x1, 0x21, v6), want: "[2001:db8::1]:12345"},
+		{desc: "v2 LOCAL", upstream: "127.0.0.0/8", header: proxyV2Header(0x0, 0x00, nil), want: "127.0.0.1"},
+		{desc: "not from upstream", upstream: "192.0.2.0/24", header: nil, want: "127.0.0.1"},
+		{desc: "missing header", upstream: "127.0.0.0/8", header: []byte("GET / HTTP/1.1\r\n\r\n"), wantErr: true},
+		{desc: "malformed v1", upstream: "127.0.0.0/8", header: []byte("PROXY TCP4 192.0.2.1\r\n"), wantErr: true},
+	}
+	for _, tc := range tests {
+		inner, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen(): %v", err)
+		}
+		l := NewProxyListener(inner, []netip.Prefix{netip.MustParsePrefix(tc.upstream)}, time.Second)
+
+		go func() {
+			c, err := net.Dial("tcp", inner.Addr().String())
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			c.Write(append(tc.header, "payload"...))
+			io.Copy(io.Discard, c)
+		}()
+
+		c, err := l.Accept()
+		if err != nil {
+			t.Fatalf("%s: Accept(): %v", tc.desc, err)
+		}
+		got := c.RemoteAddr().String()
+		buf := make([]byte, 7)
+		_, err = io.ReadFull(c, buf)
+		c.Close()
+		l.Close()
+
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: Read(): want error, got nil", tc.desc)
+			}
+			continue
+		}
+		if err != nil || string(buf) != "payload" {
+			t.Errorf("%s: Read(): want: %q, got: %q (err: %v)", tc.desc, "payload", buf, err)
+		}
+		if host, _, _ := net.SplitHostPort(got); got != tc.want && host != tc.want {
+			t.Errorf("%s: RemoteAddr(): want: %q, got: %q", tc.desc, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// ServerTLS holds the server's own certificate, the client CA pool and the
+// optional client CRL, and allows them to be replaced while the server is
+// running. Connections already established keep the material they were
+// handshaked with.
+type ServerTLS struct {
+	cfg *Config
+
+	mu     sync.RWMutex
+	cert   *tls.Certificate
+	caPool *x509.CertPool
+	crl    *x509.RevocationList
+	stamps map[string]fileStamp
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewServerTLS loads the server certificate, key and client CA certificate.
+func NewServerTLS(cfg *Config) (*ServerTLS, error) {
+	s := &ServerTLS{cfg: cfg}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *ServerTLS) files() []string {
+	files := []string{s.cfg.CertFile, s.cfg.CertKeyFile, s.cfg.CACertFile}
+	if s.cfg.CRLFile != "" {
+		files = append(files, s.cfg.CRLFile)
+	}
+	return files
+}
+
+func (s *ServerTLS) readStamps() map[string]fileStamp {
+	stamps := make(map[string]fileStamp)
+	for _, f := range s.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		stamps[f] = fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+	}
+	return stamps
+}
+
+// Reload re-reads all files. On failure, the previously loaded material is
+// kept.
+func (s *ServerTLS) Reload() error {
+	stamps := s.readStamps()
+
+	cert, err := tls.LoadX509KeyPair(s.cfg.CertFile, s.cfg.CertKeyFile)
+	if err != nil {
+		return fmt.Errorf("cannot load server certificate or key: %v", err)
+	}
+	ca, err := os.ReadFile(s.cfg.CACertFile)
+	if err != nil {
+		return fmt.Errorf("error opening CA certificate file %q: %v", s.cfg.CACertFile, err)
+	}
+	caPool := x509.NewCertPool()
+	if !caPool.AppendCertsFromPEM(ca) {
+		return fmt.Errorf("no CA certificates found in %q", s.cfg.CACertFile)
+	}
+	var crl *x509.RevocationList
+	if s.cfg.CRLFile != "" {
+		if crl, err = loadCRL(s.cfg.CRLFile, ca); err != nil {
+			return err
+		}
+		if time.Now().After(crl.NextUpdate) {
+			slog.Warn("CRL is past its next update, regenerate it", LogKeyFile, s.cfg.CRLFile, "next_update", crl.NextUpdate)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cert = &cert
+	s.caPool = caPool
+	s.crl = crl
+	s.stamps = stamps
+	return nil
+}
+
+// loadCRL reads a PEM or DER encoded CRL, which must be signed by one of the
+// CA certificates in caPEM.
+func loadCRL(fileName string, caPEM []byte) (*x509.RevocationList, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CRL file %q: %v", fileName, err)
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse CRL file %q: %v", fileName, err)
+	}
+	blocks, err := ParsePEM(caPEM)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range blocks {
+		ca, err := x509.ParseCertificate(b.Bytes)
+		if err == nil && crl.CheckSignatureFrom(ca) == nil {
+			return crl, nil
+		}
+	}
+	return nil, fmt.Errorf("CRL in %q is not signed by a client CA", fileName)
+}
+
+// Changed reports whether any of the watched files changed since the last
+// successful Reload.
+func (s *ServerTLS) Changed() bool {
+	stamps := s.readStamps()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(stamps) != len(s.stamps) {
+		return true
+	}
+	for f, st := range stamps {
+		old, ok := s.stamps[f]
+		if !ok || !old.modTime.Equal(st.modTime) || old.size != st.size {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch polls the files every interval and reloads them when they change,
+// until ctx is done.
+func (s *ServerTLS) Watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if !s.Changed() {
+				continue
+			}
+			if err := s.Reload(); err != nil {
+				slog.Error("Cannot reload TLS material, keeping previous", ErrAttr(err))
+				continue
+			}
+			slog.Info("TLS material reloaded")
+		}
+	}
+}
+
+// Certificate returns the currently loaded server certificate.
+func (s *ServerTLS) Certificate() *tls.Certificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cert
+}
+
+// CAPool returns the currently loaded client CA pool.
+func (s *ServerTLS) CAPool() *x509.CertPool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.caPool
+}
+
+// VerifyPeerCertificate implements tls.Config.VerifyPeerCertificate. It
+// rejects client certificates revoked by the loaded CRL.
+func (s *ServerTLS) VerifyPeerCertificate(_ [][]byte, chains [][]*x509.Certificate) error {
+	s.mu.RLock()
+	crl := s.crl
+	s.mu.RUnlock()
+	if crl == nil {
+		return nil
+	}
+	for _, chain := range chains {
+		leaf := chain[0]
+		if !bytes.Equal(leaf.RawIssuer, crl.RawIssuer) {
+			continue
+		}
+		for _, e := range crl.RevokedCertificateEntries {
+			if e.SerialNumber.Cmp(leaf.SerialNumber) == 0 {
+				return fmt.Errorf("client certificate %s was revoked at %v", leaf.SerialNumber.Text(16), e.RevocationTime)
+			}
+		}
+	}
+	return nil
+}
+
+// Ready reports why the server cannot serve clients at time now, or nil if it
+// can: the certificate and key files must still load, the served certificate
+// must be valid and the client CA pool must not be empty.
+func (s *ServerTLS) Ready(now time.Time) error {
+	if _, err := tls.LoadX509KeyPair(s.cfg.CertFile, s.cfg.CertKeyFile); err != nil {
+		return fmt.Errorf("cannot load server certificate or key: %v", err)
+	}
+	cert, caPool := s.Certificate(), s.CAPool()
+	if cert == nil || cert.Leaf == nil {
+		return errors.New("no server certificate loaded")
+	}
+	if now.Before(cert.Leaf.NotBefore) || now.After(cert.Leaf.NotAfter) {
+		return fmt.Errorf("served certificate is only valid from %v to %v", cert.Leaf.NotBefore, cert.Leaf.NotAfter)
+	}
+	if caPool == nil || caPool.Equal(x509.NewCertPool()) {
+		return errors.New("client CA pool is empty")
+	}
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (s *ServerTLS) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.Certificate(), nil
+}
+
+// ConfigForClient returns a tls.Config.GetConfigForClient callback that
+// clones base with the current client CA pool.
+func (s *ServerTLS) ConfigForClient(base *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		tc := base.Clone()
+		tc.GetConfigForClient = nil
+		tc.GetCertificate = s.GetCertificate
+		tc.ClientCAs = s.CAPool()
+		tc.VerifyPeerCertificate = s.VerifyPeerCertificate
+		return tc, nil
+	}
+}
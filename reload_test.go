@@ -0,0 +1,182 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServerTLSReload(t *testing.T) {
+	dir := t.TempDir()
+	ca, leaf := newTestChain(t, "server.example.com")
+
+	cfg := NewConfig("test_binary", "test_version", "test_commit")
+	cfg.CertFile = writeFile(t, dir, "cert.pem", string(leaf.certPEM))
+	cfg.CertKeyFile = writeFile(t, dir, "key.pem", string(leaf.keyPEM))
+	cfg.CACertFile = writeFile(t, dir, "ca.pem", string(ca.certPEM))
+
+	s, err := NewServerTLS(cfg)
+	if err != nil {
+		t.Fatalf("NewServerTLS(): %v", err)
+	}
+	if s.Changed() {
+		t.Errorf("Changed() right after load: want false, got true")
+	}
+	first, _ := s.GetCertificate(nil)
+
+	// A broken key must not replace the loaded material.
+	writeFile(t, dir, "key.pem", "garbage")
+	if !s.Changed() {
+		t.Errorf("Changed() after key rewrite: want true, got false")
+	}
+	if err := s.Reload(); err == nil {
+		t.Errorf("Reload() with broken key: want error, got nil")
+	}
+	if got, _ := s.GetCertificate(nil); got != first {
+		t.Errorf("GetCertificate() after failed reload: certificate was replaced")
+	}
+
+	_, leaf2 := newTestChain(t, "server.example.com")
+	writeFile(t, dir, "cert.pem", string(leaf2.certPEM))
+	writeFile(t, dir, "key.pem", string(leaf2.keyPEM))
+	// Ensure a distinct mtime on coarse-grained filesystems.
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(cfg.CertFile, future, future)
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Reload(): %v", err)
+	}
+	got, _ := s.GetCertificate(nil)
+	if got == first || got.Leaf == nil || !got.Leaf.Equal(leaf2.cert) {
+		t.Errorf("GetCertificate() after reload: want the new certificate")
+	}
+
+	base := &tls.Config{MinVersion: tls.VersionTLS13}
+	tc, err := s.ConfigForClient(base)(nil)
+	if err != nil || tc.ClientCAs != s.CAPool() || tc.MinVersion != tls.VersionTLS13 {
+		t.Errorf("ConfigForClient(): want clone of base with current CA pool, got: %+v (err: %v)", tc, err)
+	}
+}
+
+func TestServerTLSReady(t *testing.T) {
+	dir := t.TempDir()
+	ca, leaf := newTestChain(t, "server.example.com")
+
+	cfg := NewConfig("test_binary", "test_version", "test_commit")
+	cfg.CertFile = writeFile(t, dir, "cert.pem", string(leaf.certPEM))
+	cfg.CertKeyFile = writeFile(t, dir, "key.pem", string(leaf.keyPEM))
+	cfg.CACertFile = writeFile(t, dir, "ca.pem", string(ca.certPEM))
+
+	s, err := NewServerTLS(cfg)
+	if err != nil {
+		t.Fatalf("NewServerTLS(): %v", err)
+	}
+	now := time.Now()
+	if err := s.Ready(now); err != nil {
+		t.Errorf("Ready(): want nil, got: %v", err)
+	}
+	if err := s.Ready(leaf.cert.NotAfter.Add(time.Second)); err == nil {
+		t.Errorf("Ready(after NotAfter): want error, got nil")
+	}
+	if err := s.Ready(leaf.cert.NotBefore.Add(-time.Second)); err == nil {
+		t.Errorf("Ready(before NotBefore): want error, got nil")
+	}
+
+	writeFile(t, dir, "key.pem", "garbage")
+	if err := s.Ready(now); err == nil {
+		t.Errorf("Ready() with unreadable key: want error, got nil")
+	}
+}
+
+func TestServerTLSCRL(t *testing.T) {
+	dir := t.TempDir()
+	_, leaf := newTestChain(t, "server.example.com")
+	caDir := filepath.Join(dir, "ca")
+	ca, err := InitCA(caDir, pkix.Name{CommonName: "Client CA"}, KeyECDSAP256, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("InitCA(): %v", err)
+	}
+	issue := func() *x509.Certificate {
+		certPEM, _, err := ca.Issue(IssueRequest{Subject: pkix.Name{CommonName: "client.example.com"}, Lifetime: time.Hour}, KeyECDSAP256)
+		if err != nil {
+			t.Fatalf("Issue(): %v", err)
+		}
+		block, _ := pem.Decode(certPEM)
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatalf("cannot parse issued certificate: %v", err)
+		}
+		return cert
+	}
+	revoked, good := issue(), issue()
+
+	cfg := NewConfig("test_binary", "test_version", "test_commit")
+	cfg.CertFile = writeFile(t, dir, "cert.pem", string(leaf.certPEM))
+	cfg.CertKeyFile = writeFile(t, dir, "key.pem", string(leaf.keyPEM))
+	cfg.CACertFile = filepath.Join(caDir, CACertFileName)
+	cfg.CRLFile = filepath.Join(caDir, CACRLFileName)
+
+	s, err := NewServerTLS(cfg)
+	if err != nil {
+		t.Fatalf("NewServerTLS(): %v", err)
+	}
+	tc, _ := s.ConfigForClient(&tls.Config{})(nil)
+	verify := func(cert *x509.Certificate) error {
+		return tc.VerifyPeerCertificate(nil, [][]*x509.Certificate{{cert, ca.Cert}})
+	}
+	if err := verify(revoked); err != nil {
+		t.Errorf("VerifyPeerCertificate() before revocation: %v", err)
+	}
+
+	if err := ca.Revoke(revoked.SerialNumber.Text(16), time.Hour); err != nil {
+		t.Fatalf("Revoke(): %v", err)
+	}
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(cfg.CRLFile, future, future)
+	if !s.Changed() {
+		t.Errorf("Changed() after CRL rewrite: want true, got false")
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Reload(): %v", err)
+	}
+	if err := verify(revoked); err == nil {
+		t.Errorf("VerifyPeerCertificate(revoked): want error, got nil")
+	}
+	if err := verify(good); err != nil {
+		t.Errorf("VerifyPeerCertificate(not revoked): %v", err)
+	}
+
+	// A CRL not signed by a client CA must not replace the loaded one.
+	other, err := InitCA(filepath.Join(dir, "other"), pkix.Name{CommonName: "Client CA"}, KeyECDSAP256, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("InitCA(): %v", err)
+	}
+	data, _ := os.ReadFile(filepath.Join(other.Dir, CACRLFileName))
+	writeFile(t, caDir, CACRLFileName, string(data))
+	if err := s.Reload(); err == nil {
+		t.Errorf("Reload() with foreign CRL: want error, got nil")
+	}
+	if err := verify(revoked); err == nil {
+		t.Errorf("VerifyPeerCertificate(revoked) after failed reload: want error, got nil")
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultResolvConf is where NewDNSResolver finds the system name servers.
+const DefaultResolvConf = "/etc/resolv.conf"
+
+// TTLResolver is a Resolver that also reports how long its answers, including
+// "not found", may be cached.
+type TTLResolver interface {
+	Resolver
+	LookupAddrTTL(context.Context, string) ([]string, time.Duration, error)
+	LookupIPAddrTTL(context.Context, string) ([]net.IPAddr, time.Duration, error)
+}
+
+// DNSResolver queries name servers directly, so that it can report the TTLs
+// the system resolver hides. Names are always treated as fully qualified:
+// there is no search list and no hosts file.
+type DNSResolver struct {
+	// Servers are tried in order, as host:port.
+	Servers []string
+	// Timeout of each query. Zero means the miekg/dns default.
+	Timeout time.Duration
+}
+
+// NewDNSResolver returns a DNSResolver for servers. Servers without a port
+// use port 53. With no servers, those in DefaultResolvConf are used.
+func NewDNSResolver(servers []string) (*DNSResolver, error) {
+	if len(servers) == 0 {
+		cc, err := dns.ClientConfigFromFile(DefaultResolvConf)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range cc.Servers {
+			servers = append(servers, net.JoinHostPort(s, cc.Port))
+		}
+	}
+	r := &DNSResolver{}
+	for _, s := range servers {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(strings.Trim(s, "[]"), "53")
+		}
+		r.Servers = append(r.Servers, s)
+	}
+	if len(r.Servers) == 0 {
+		return nil, errors.New("no DNS servers")
+	}
+	return r, nil
+}
+
+// exchange sends a query for name to each server in turn, until one answers
+// with NOERROR or NXDOMAIN.
+func (r *DNSResolver) exchange(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.SetEdns0(dns.DefaultMsgSize, false)
+
+	dnsErr := &net.DNSError{Name: name, IsTemporary: true}
+	for _, s := range r.Servers {
+		dnsErr.Server = s
+		c := &dns.Client{Timeout: r.Timeout}
+		in, _, err := c.ExchangeContext(ctx, m, s)
+		if err == nil && in.Truncated {
+			c.Net = "tcp"
+			in, _, err = c.ExchangeContext(ctx, m, s)
+		}
+		if err != nil {
+			var netErr net.Error
+			dnsErr.Err, dnsErr.IsTimeout = err.Error(), errors.As(err, &netErr) && netErr.Timeout()
+			continue
+		}
+		if in.Rcode != dns.RcodeSuccess && in.Rcode != dns.RcodeNameError {
+			dnsErr.Err, dnsErr.IsTimeout = "server answered "+dns.RcodeToString[in.Rcode], false
+			continue
+		}
+		return in, nil
+	}
+	return nil, dnsErr
+}
+
+// negativeTTL returns how long the absence of an answer may be cached, per
+// RFC 2308.
+func negativeTTL(m *dns.Msg) time.Duration {
+	for _, rr := range m.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return time.Duration(min(soa.Hdr.Ttl, soa.Minttl)) * time.Second
+		}
+	}
+	return 0
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// LookupIPAddrTTL implements TTLResolver.
+func (r *DNSResolver) LookupIPAddrTTL(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	var (
+		addrs []net.IPAddr
+		ttl   uint32
+		neg   time.Duration
+	)
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		m, err := r.exchange(ctx, host, qtype)
+		if err != nil {
+			return nil, 0, err
+		}
+		neg = max(neg, negativeTTL(m))
+		if m.Rcode == dns.RcodeNameError {
+			break
+		}
+		for _, rr := range m.Answer {
+			var ip net.IP
+			switch rr := rr.(type) {
+			case *dns.A:
+				ip = rr.A
+			case *dns.AAAA:
+				ip = rr.AAAA
+			default:
+				continue
+			}
+			if len(addrs) == 0 || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+			addrs = append(addrs, net.IPAddr{IP: ip})
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, neg, notFound(host)
+	}
+	return addrs, time.Duration(ttl) * time.Second, nil
+}
+
+// LookupAddrTTL implements TTLResolver.
+func (r *DNSResolver) LookupAddrTTL(ctx context.Context, addr string) ([]string, time.Duration, error) {
+	arpa, err := dns.ReverseAddr(addr)
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: addr}
+	}
+	m, err := r.exchange(ctx, arpa, dns.TypePTR)
+	if err != nil {
+		return nil, 0, err
+	}
+	var (
+		names []string
+		ttl   uint32
+	)
+	for _, rr := range m.Answer {
+		if ptr, ok := rr.(*dns.PTR); ok {
+			if len(names) == 0 || ptr.Hdr.Ttl < ttl {
+				ttl = ptr.Hdr.Ttl
+			}
+			names = append(names, ptr.Ptr)
+		}
+	}
+	if len(names) == 0 {
+		return nil, negativeTTL(m), notFound(addr)
+	}
+	return names, time.Duration(ttl) * time.Second, nil
+}
+
+// LookupIPAddr implements Resolver.
+func (r *DNSResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, _, err := r.LookupIPAddrTTL(ctx, host)
+	return addrs, err
+}
+
+// LookupAddr implements Resolver.
+func (r *DNSResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	names, _, err := r.LookupAddrTTL(ctx, addr)
+	return names, err
+}
+
+// LookupHost implements Resolver.
+func (r *DNSResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return ipAddrStrings(r.LookupIPAddr(ctx, host))
+}
+
+func ipAddrStrings(addrs []net.IPAddr, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	s := make([]string, len(addrs))
+	for i, a := range addrs {
+		s[i] = a.String()
+	}
+	return s, nil
+}
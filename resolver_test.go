@@ -0,0 +1,106 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/go-mockdns"
+)
+
+func TestDNSResolver(t *testing.T) {
+	srv, err := mockdns.NewServerWithLogger(setUp().Resolver.(*mockdns.Resolver).Zones, log.New(io.Discard, "", 0), false)
+	if err != nil {
+		t.Fatalf("cannot start DNS server: %v", err)
+	}
+	defer srv.Close()
+
+	r, err := NewDNSResolver([]string{srv.LocalAddr().String()})
+	if err != nil {
+		t.Fatalf("NewDNSResolver(): %v", err)
+	}
+	ctx := context.Background()
+
+	addrs, ttl, err := r.LookupIPAddrTTL(ctx, "valid.example.com")
+	if err != nil || len(addrs) != 2 || ttl != 9999*time.Second {
+		t.Errorf("LookupIPAddrTTL(): want 2 addresses with TTL 9999s, got: %v, %v (err: %v)", addrs, ttl, err)
+	}
+	if addrs, _, err := r.LookupIPAddrTTL(ctx, "cname-for-valid.example.com"); err != nil || len(addrs) != 2 {
+		t.Errorf("LookupIPAddrTTL(CNAME): want 2 addresses, got: %v (err: %v)", addrs, err)
+	}
+	names, _, err := r.LookupAddrTTL(ctx, "10.0.0.1")
+	if err != nil || len(names) != 1 || names[0] != "valid.example.com." {
+		t.Errorf("LookupAddrTTL(): want [valid.example.com.], got: %v (err: %v)", names, err)
+	}
+
+	_, ttl, err = r.LookupIPAddrTTL(ctx, "invalid.example.com")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound || ttl != 60*time.Second {
+		t.Errorf("LookupIPAddrTTL(invalid): want not found with negative TTL 60s, got: %v (err: %v)", ttl, err)
+	}
+
+	// A validation round trip through the DNS resolver.
+	cfg := setUp()
+	cfg.Resolver = r
+	if err := ValidateAddresses(context.Background(), cfg, discardLogger, "valid.example.com", net.ParseIP("10.0.0.1")); err != nil {
+		t.Errorf("ValidateAddresses(): %v", err)
+	}
+}
+
+func TestDNSResolverUnavailable(t *testing.T) {
+	// Nothing listens on a port that was just released.
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	addr := l.LocalAddr().String()
+	l.Close()
+
+	r, err := NewDNSResolver([]string{addr})
+	if err != nil {
+		t.Fatalf("NewDNSResolver(): %v", err)
+	}
+	r.Timeout = 100 * time.Millisecond
+	_, err = r.LookupIPAddr(context.Background(), "valid.example.com")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || dnsErr.IsNotFound || !dnsErr.IsTemporary {
+		t.Errorf("LookupIPAddr(): want temporary DNS error, got: %v", err)
+	}
+}
+
+func TestNewDNSResolver(t *testing.T) {
+	r, err := NewDNSResolver([]string{"192.0.2.1", "192.0.2.2:5353", "2001:db8::1", "[2001:db8::2]"})
+	if err != nil {
+		t.Fatalf("NewDNSResolver(): %v", err)
+	}
+	want := []string{"192.0.2.1:53", "192.0.2.2:5353", "[2001:db8::1]:53", "[2001:db8::2]:53"}
+	if len(r.Servers) != len(want) {
+		t.Fatalf("NewDNSResolver(): want: %q, got: %q", want, r.Servers)
+	}
+	for i := range want {
+		if r.Servers[i] != want[i] {
+			t.Errorf("NewDNSResolver(): want: %q, got: %q", want, r.Servers)
+			break
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"time"
+)
+
+// ReadCertificate returns the first certificate found in a PEM file.
+func ReadCertificate(fileName string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read certificate file %q: %v", fileName, err)
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no certificate found in %q", fileName)
+		}
+		if block.Type != PEMTypeCertificate {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse certificate in %q: %v", fileName, err)
+		}
+		return cert, nil
+	}
+}
+
+// RenewalTime returns the time at which a certificate should be renewed: after
+// the given fraction of its lifetime, moved earlier by a random amount of up
+// to jitter.
+func RenewalTime(cert *x509.Certificate, fraction float64, jitter time.Duration) time.Time {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	t := cert.NotBefore.Add(time.Duration(float64(lifetime) * fraction))
+	if jitter > 0 {
+		t = t.Add(-rand.N(jitter))
+	}
+	return t
+}
+
+// CheckSchedule verifies the daemon mode intervals in cfg. A delay of zero
+// between fetches or retries would refetch in a tight loop.
+func CheckSchedule(cfg *Config) error {
+	if cfg.MaxInterval <= 0 {
+		return fmt.Errorf("max_interval must be positive, got %v", cfg.MaxInterval)
+	}
+	if cfg.RetryMax <= 0 {
+		return fmt.Errorf("retry_max must be positive, got %v", cfg.RetryMax)
+	}
+	if cfg.RenewJitter < 0 {
+		return fmt.Errorf("renew_jitter must not be negative, got %v", cfg.RenewJitter)
+	}
+	return nil
+}
+
+// Backoff returns the delay before retry number attempt (starting at 0),
+// doubling from min and capped at max.
+func Backoff(attempt int, min, max time.Duration) time.Duration {
+	d := min
+	for i := 0; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
@@ -0,0 +1,104 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"crypto/x509"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadCertificate(t *testing.T) {
+	dir := t.TempDir()
+	_, leaf := newTestChain(t, "host.example.com")
+
+	// Key first, to make sure non-certificate blocks are skipped.
+	p := writeFile(t, dir, "bundle.pem", string(leaf.keyPEM)+string(leaf.certPEM))
+	got, err := ReadCertificate(p)
+	if err != nil || !got.Equal(leaf.cert) {
+		t.Errorf("ReadCertificate(): want leaf certificate, got: %v (err: %v)", got, err)
+	}
+
+	for _, p := range []string{
+		writeFile(t, dir, "key.pem", string(leaf.keyPEM)),
+		writeFile(t, dir, "empty.pem", ""),
+		filepath.Join(dir, "missing.pem"),
+	} {
+		if _, err := ReadCertificate(p); err == nil {
+			t.Errorf("ReadCertificate(%q): want error, got nil", p)
+		}
+	}
+}
+
+func TestRenewalTime(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	cert := &x509.Certificate{
+		NotBefore: start,
+		NotAfter:  start.Add(90 * 24 * time.Hour),
+	}
+	want := start.Add(60 * 24 * time.Hour)
+	if got := RenewalTime(cert, 2.0/3, 0); !got.Equal(want) {
+		t.Errorf("RenewalTime(no jitter): want: %v, got: %v", want, got)
+	}
+	for i := 0; i < 100; i++ {
+		got := RenewalTime(cert, 2.0/3, time.Hour)
+		if got.After(want) || got.Before(want.Add(-time.Hour)) {
+			t.Fatalf("RenewalTime(1h jitter): want within [%v, %v], got: %v", want.Add(-time.Hour), want, got)
+		}
+	}
+}
+
+func TestCheckSchedule(t *testing.T) {
+	var tests = []struct {
+		desc    string
+		modify  func(*Config)
+		wantErr bool
+	}{
+		{desc: "defaults", modify: func(*Config) {}},
+		{desc: "zero max_interval", modify: func(c *Config) { c.MaxInterval = 0 }, wantErr: true},
+		{desc: "negative max_interval", modify: func(c *Config) { c.MaxInterval = -time.Hour }, wantErr: true},
+		{desc: "zero retry_max", modify: func(c *Config) { c.RetryMax = 0 }, wantErr: true},
+		{desc: "negative renew_jitter", modify: func(c *Config) { c.RenewJitter = -time.Hour }, wantErr: true},
+		{desc: "zero renew_jitter", modify: func(c *Config) { c.RenewJitter = 0 }},
+	}
+	for _, tc := range tests {
+		cfg := NewConfig("test_binary", "test_version", "test_commit")
+		tc.modify(cfg)
+		if err := CheckSchedule(cfg); (err != nil) != tc.wantErr {
+			t.Errorf("CheckSchedule(%s): wantErr: %v, got: %v", tc.desc, tc.wantErr, err)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	var tests = []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{attempt: 0, want: time.Minute},
+		{attempt: 1, want: 2 * time.Minute},
+		{attempt: 3, want: 8 * time.Minute},
+		{attempt: 6, want: time.Hour},
+		{attempt: 1000, want: time.Hour},
+	}
+	for _, tc := range tests {
+		if got := Backoff(tc.attempt, time.Minute, time.Hour); got != tc.want {
+			t.Errorf("Backoff(%d): want: %v, got: %v", tc.attempt, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"log/slog"
+	"net/http"
+	"time"
+
+	cs "github.com/icemarkom/certsync"
+	"github.com/icemarkom/certsync/common"
+)
+
+// acmeCheckInterval is how often ACME bundles are checked for renewal.
+const acmeCheckInterval = time.Hour
+
+// acmeReload is signaled when the bundles are reloaded, so that ACME bundles
+// added by the reload are obtained right away.
+var acmeReload = make(chan struct{}, 1)
+
+// acmeBundles returns the bundles whose certificates are obtained via ACME.
+func acmeBundles() []*cs.Bundle {
+	var acme []*cs.Bundle
+	for _, b := range bundles.Load().Bundles {
+		if len(b.ACME) > 0 {
+			acme = append(acme, b)
+		}
+	}
+	return acme
+}
+
+// setupACME creates the ACME issuer and, unless a DNS hook is configured,
+// starts the HTTP-01 challenge listener.
+func setupACME() (*cs.ACMEIssuer, error) {
+	var roots *x509.CertPool
+	if cfg.ACMECAFile != "" {
+		var err error
+		if roots, err = cs.LoadCertPool(cfg.ACMECAFile); err != nil {
+			return nil, err
+		}
+	}
+	issuer, err := cs.NewACMEIssuer(cfg.ACMEDirectory, cfg.ACMEAccountKey, roots)
+	if err != nil {
+		return nil, err
+	}
+	issuer.Email = cfg.ACMEEmail
+	issuer.KeyType = cfg.KeyType
+	if cfg.ACMEDNSHook != "" {
+		issuer.DNS = &cs.ExecDNSProvider{Command: cfg.ACMEDNSHook, Timeout: cfg.HookTimeout}
+		slog.Info("Using DNS-01 ACME challenges", "hook", cfg.ACMEDNSHook)
+		return issuer, nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(cs.ACMEChallengePath, issuer)
+	if err := common.Serve("ACME HTTP-01", cfg.ACMEHTTPAddr, mux, cfg.Timeout, nil); err != nil {
+		return nil, err
+	}
+	slog.Info("Answering HTTP-01 ACME challenges", cs.LogKeyAddr, cfg.ACMEHTTPAddr)
+	return issuer, nil
+}
+
+// renewACME renews every ACME bundle that is due, and reports whether any
+// was renewed.
+func renewACME(ctx context.Context, issuer *cs.ACMEIssuer, acme []*cs.Bundle) bool {
+	renewed := false
+	for _, b := range acme {
+		ok, err := issuer.Renew(ctx, b)
+		if err != nil {
+			slog.Error("ACME renewal failed", cs.LogKeyBundle, b.Name, "retry_in", acmeCheckInterval, cs.ErrAttr(err))
+			continue
+		}
+		if ok {
+			slog.Info("Obtained new ACME certificate", cs.LogKeyBundle, b.Name, "domains", b.ACME)
+			renewed = true
+		}
+	}
+	return renewed
+}
+
+// watchACME renews ACME bundles periodically and after every bundle reload,
+// reloading the server's own TLS material in case it is one of them. The set
+// of ACME bundles is taken from the current bundles each time. If issuer is
+// nil, it is set up once there are ACME bundles.
+func watchACME(ctx context.Context, issuer *cs.ACMEIssuer) {
+	t := time.NewTicker(acmeCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		case <-acmeReload:
+		}
+		acme := acmeBundles()
+		if len(acme) == 0 {
+			continue
+		}
+		if issuer == nil {
+			var err error
+			if issuer, err = setupACME(); err != nil {
+				slog.Error("Unable to configure ACME", "retry_in", acmeCheckInterval, cs.ErrAttr(err))
+				continue
+			}
+		}
+		if !renewACME(ctx, issuer, acme) {
+			continue
+		}
+		if err := serverTLS.Reload(); err != nil {
+			slog.Error("Cannot reload TLS material after ACME renewal, keeping previous", cs.ErrAttr(err))
+		}
+	}
+}
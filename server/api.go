@@ -0,0 +1,82 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	cs "github.com/icemarkom/certsync"
+)
+
+// writeJSON encodes v before writing anything, so that a failure never yields
+// a partial response.
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("Cannot encode JSON response", cs.ErrAttr(err))
+		code = http.StatusInternalServerError
+		data, _ = json.Marshal(cs.ErrorResponse{Error: http.StatusText(code)})
+	}
+	w.Header().Set("Content-Type", cs.ContentTypeJSON)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	w.Write(append(data, '\n'))
+}
+
+func jsonError(w http.ResponseWriter, code int) {
+	writeJSON(w, code, cs.ErrorResponse{Error: http.StatusText(code)})
+}
+
+func handleBundleV1(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		reject(w, r, jsonError, requestLogger(r), http.StatusMethodNotAllowed, outcomeBadRequest, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	id, bundle, data, ok := selectBundle(w, r, jsonError)
+	if !ok {
+		return
+	}
+	logger := requestLogger(r).With(cs.LogKeyIdentity, id.String(), cs.LogKeyBundle, bundle.Name)
+	resp, err := cs.NewBundleResponse(bundle.Name, data)
+	if err != nil {
+		reject(w, r, jsonError, logger, http.StatusInternalServerError, outcomeFileError, err)
+		return
+	}
+	pub, code, err := wrapRecipient(r, id)
+	if err != nil {
+		reject(w, r, jsonError, logger, code, outcomeError, err)
+		return
+	}
+	if pub != nil {
+		wrapped, err := cs.WrapKey([]byte(resp.Key), pub)
+		if err != nil {
+			reject(w, r, jsonError, logger, wrapErrorStatus(err), outcomeError, err)
+			return
+		}
+		resp.Key, resp.KeyWrap = string(wrapped), cs.KeyWrapHPKE
+		w.Header().Set(cs.HeaderKeyWrap, cs.KeyWrapHPKE)
+	}
+	writeJSON(w, http.StatusOK, resp)
+	countRequest(r, outcomeServed)
+	recordFetch(id)
+	logger.Info("Bundle sent")
+}
@@ -0,0 +1,135 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	cs "github.com/icemarkom/certsync"
+)
+
+var auditLog *cs.AuditLog
+
+type auditKey struct{}
+
+// auditWriter records the status and size of a response.
+type auditWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *auditWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *auditWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *auditWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// auditHandler writes an audit record for every request served by next.
+// Handlers add to the record with the audit* helpers.
+func auditHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &cs.AuditRecord{
+			Time:       start.UTC(),
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			RemoteAddr: r.RemoteAddr,
+			XFF:        r.Header.Get("X-Forwarded-For"),
+		}
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			rec.Subject = r.TLS.VerifiedChains[0][0].Subject.String()
+			rec.ChainFingerprint = cs.ChainFingerprint(r.TLS.VerifiedChains[0])
+		}
+		aw := &auditWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, r.WithContext(context.WithValue(r.Context(), auditKey{}, rec)))
+
+		rec.Status, rec.Bytes = aw.status, aw.bytes
+		if rec.Status == 0 {
+			rec.Status = http.StatusOK
+		}
+		rec.KeyWrap = w.Header().Get(cs.HeaderKeyWrap)
+		rec.Latency = time.Since(start).Seconds()
+		if err := auditLog.Write(rec); err != nil {
+			slog.Error("Cannot write audit record", cs.ErrAttr(err))
+		}
+	})
+}
+
+// auditRecord returns the audit record of r, or nil if auditing is disabled.
+func auditRecord(r *http.Request) *cs.AuditRecord {
+	rec, _ := r.Context().Value(auditKey{}).(*cs.AuditRecord)
+	return rec
+}
+
+// auditOutcome records the outcome of a request. It is called by countRequest.
+func auditOutcome(r *http.Request, outcome string) {
+	if rec := auditRecord(r); rec != nil {
+		rec.Handler, rec.Result = r.Pattern, outcome
+	}
+}
+
+// auditReason records why a request failed.
+func auditReason(r *http.Request, err error) {
+	if rec := auditRecord(r); rec != nil {
+		rec.Reason = err.Error()
+	}
+}
+
+// auditClient records the validated client address and identity.
+func auditClient(r *http.Request, ip string, id cs.Identity) {
+	if rec := auditRecord(r); rec != nil {
+		rec.SourceIP = ip
+		if id.Value != "" {
+			rec.Identity = id.String()
+		}
+	}
+}
+
+// auditBundle records the bundle or certificate sent to the client.
+func auditBundle(r *http.Request, name string, data []byte) {
+	if rec := auditRecord(r); rec != nil {
+		rec.SetBundle(name, data)
+	}
+}
+
+func verifyAuditLog(fileName string) (int, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return cs.VerifyAuditLog(f, true)
+}
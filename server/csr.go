@@ -0,0 +1,70 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	cs "github.com/icemarkom/certsync"
+)
+
+const maxCSRSize = 64 << 10
+
+func handleCSR(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	logger := requestLogger(r)
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		reject(w, r, textError, logger, http.StatusMethodNotAllowed, outcomeBadRequest, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	id, err := validRequest(r)
+	if err != nil {
+		reject(w, r, textError, logger, validationStatus(err), validationOutcome(err), err)
+		return
+	}
+	logger = logger.With(cs.LogKeyIdentity, id.String())
+	logger.Info("Client validated")
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxCSRSize))
+	if err != nil {
+		reject(w, r, textError, logger, http.StatusBadRequest, outcomeBadRequest, fmt.Errorf("cannot read CSR: %v", err))
+		return
+	}
+	csr, err := cs.ParseCSR(data)
+	if err != nil {
+		reject(w, r, textError, logger, http.StatusBadRequest, outcomeBadRequest, err)
+		return
+	}
+	if err := cs.CheckCSR(csr, id); err != nil {
+		reject(w, r, textError, logger, http.StatusForbidden, outcomeForbidden, err)
+		return
+	}
+	chain, err := issuingCA.SignCSR(csr, cfg.CSRLifetime, cfg.CSRServerAuth)
+	if err != nil {
+		reject(w, r, textError, logger, http.StatusInternalServerError, outcomeError, err)
+		return
+	}
+	auditBundle(r, "", chain)
+	w.Header().Set("Content-Type", cs.ContentTypePEM)
+	w.Write(chain)
+	countRequest(r, outcomeServed)
+	recordFetch(id)
+	logger.Info("Certificate issued", "names", csr.DNSNames)
+}
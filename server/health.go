@@ -0,0 +1,65 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	cs "github.com/icemarkom/certsync"
+	"github.com/icemarkom/certsync/common"
+)
+
+// handleHealthz reports that the process is alive.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReadyz reports whether the server can serve bundles: its certificate,
+// key and client CA pool are usable and the resolver answers.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	err := serverTLS.Ready(time.Now())
+	if err == nil {
+		// Leave time to answer within the WriteTimeout of the listener.
+		ctx, cancel := context.WithTimeout(r.Context(), cfg.Timeout/2)
+		defer cancel()
+		err = cs.CheckResolver(ctx, cfg)
+	}
+	if err != nil {
+		slog.Warn("Not ready", cs.ErrAttr(err))
+		http.Error(w, fmt.Sprintf("not ready: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// setupHealth starts the plain HTTP /healthz and /readyz listener, which does
+// not require client certificates.
+func setupHealth() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", handleHealthz)
+	mux.HandleFunc("GET /readyz", handleReadyz)
+
+	if err := common.Serve("Health", cfg.HealthAddr, mux, cfg.Timeout, nil); err != nil {
+		return err
+	}
+	slog.Info("Serving health checks", cs.LogKeyAddr, cfg.HealthAddr)
+	return nil
+}
@@ -0,0 +1,243 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	cs "github.com/icemarkom/certsync"
+	"github.com/icemarkom/certsync/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// maxFetchClients caps the client label set of metricClientLastFetch.
+// Fetches of clients beyond it are recorded under fetchClientOther.
+const (
+	maxFetchClients  = 5000
+	fetchClientOther = "_other"
+)
+
+// Request outcomes.
+const (
+	outcomeServed        = "served"
+	outcomeNotModified   = "not_modified"
+	outcomeForbidden     = "forbidden"
+	outcomeLookupFailure = "lookup_failure"
+	outcomeNoBundle      = "no_bundle"
+	outcomeFileError     = "file_error"
+	outcomeBadRequest    = "bad_request"
+	outcomeError         = "error"
+)
+
+var (
+	metricRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "certsync_server_requests_total",
+		Help: "Requests by handler and outcome.",
+	}, []string{"handler", "outcome"})
+
+	metricLookupDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "certsync_server_dns_lookup_duration_seconds",
+		Help:    "Latency of DNS lookups made to validate clients.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"type", "result"})
+
+	metricHandshakeFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "certsync_server_tls_handshake_failures_total",
+		Help: "Failed TLS handshakes, including clients without an acceptable certificate.",
+	})
+
+	metricClientLastFetch = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "certsync_server_client_last_fetch_timestamp_seconds",
+		Help: "Time a client last fetched a bundle, by validated client identity.",
+	}, []string{"client"})
+
+	// fetchClients are the client labels of metricClientLastFetch.
+	fetchClients = struct {
+		sync.Mutex
+		seen map[string]bool
+	}{seen: make(map[string]bool)}
+
+	descBundleExpiry = prometheus.NewDesc(
+		"certsync_server_bundle_expiry_timestamp_seconds",
+		"NotAfter of the certificate of each served bundle.",
+		[]string{"bundle"}, nil,
+	)
+)
+
+// countRequest records the outcome of a request to one of the registered
+// handlers, in the metrics and the audit log.
+func countRequest(r *http.Request, outcome string) {
+	metricRequests.WithLabelValues(r.Pattern, outcome).Inc()
+	auditOutcome(r, outcome)
+}
+
+// recordFetch records a successful fetch by a client, whose identity must have
+// been validated, so that clients cannot create labels at will.
+func recordFetch(id cs.Identity) {
+	label := id.Value
+	fetchClients.Lock()
+	if !fetchClients.seen[label] {
+		if len(fetchClients.seen) < maxFetchClients {
+			fetchClients.seen[label] = true
+		} else {
+			label = fetchClientOther
+		}
+	}
+	fetchClients.Unlock()
+	metricClientLastFetch.WithLabelValues(label).SetToCurrentTime()
+}
+
+// validationOutcome returns the request outcome for a client validation
+// error.
+func validationOutcome(err error) string {
+	if errors.Is(err, cs.ErrLookupFailed) {
+		return outcomeLookupFailure
+	}
+	return outcomeForbidden
+}
+
+// bundleCollector exports the expiry of every bundle, read at scrape time.
+type bundleCollector struct{}
+
+func (bundleCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- descBundleExpiry
+}
+
+func (bundleCollector) Collect(ch chan<- prometheus.Metric) {
+	for name, b := range bundles.Load().Bundles {
+		cert, err := cs.ReadCertificate(b.CertFile)
+		if err != nil {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(descBundleExpiry, prometheus.GaugeValue, float64(cert.NotAfter.Unix()), name)
+	}
+}
+
+// timedResolver records the latency of every lookup.
+type timedResolver struct {
+	cs.Resolver
+}
+
+// timedTTLResolver is a timedResolver that keeps the TTLs of its upstream.
+type timedTTLResolver struct {
+	timedResolver
+	ttl cs.TTLResolver
+}
+
+func newTimedResolver(r cs.Resolver) cs.Resolver {
+	if tr, ok := r.(cs.TTLResolver); ok {
+		return timedTTLResolver{timedResolver{r}, tr}
+	}
+	return timedResolver{r}
+}
+
+func observeLookup(typ string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	metricLookupDuration.WithLabelValues(typ, result).Observe(time.Since(start).Seconds())
+}
+
+func (t timedResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	start := time.Now()
+	names, err := t.Resolver.LookupAddr(ctx, addr)
+	observeLookup("PTR", start, err)
+	return names, err
+}
+
+func (t timedResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	start := time.Now()
+	addrs, err := t.Resolver.LookupIPAddr(ctx, host)
+	observeLookup("A/AAAA", start, err)
+	return addrs, err
+}
+
+func (t timedResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	start := time.Now()
+	addrs, err := t.Resolver.LookupHost(ctx, host)
+	observeLookup("A/AAAA", start, err)
+	return addrs, err
+}
+
+func (t timedTTLResolver) LookupAddrTTL(ctx context.Context, addr string) ([]string, time.Duration, error) {
+	start := time.Now()
+	names, ttl, err := t.ttl.LookupAddrTTL(ctx, addr)
+	observeLookup("PTR", start, err)
+	return names, ttl, err
+}
+
+func (t timedTTLResolver) LookupIPAddrTTL(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	start := time.Now()
+	addrs, ttl, err := t.ttl.LookupIPAddrTTL(ctx, host)
+	observeLookup("A/AAAA", start, err)
+	return addrs, ttl, err
+}
+
+// handshakeErrorLog is the http.Server error log. It counts TLS handshake
+// failures, which net/http only reports there, as "http: TLS handshake error
+// from <addr>: <err>". Handshakes that fail before the ClientHello, or in
+// client certificate verification, never reach a hook of the TLS config, so
+// the log is the only complete source. TestHandshakeErrorLog catches a change
+// of the message.
+type handshakeErrorLog struct{}
+
+func (handshakeErrorLog) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte("TLS handshake error")) {
+		metricHandshakeFailures.Inc()
+	}
+	slog.Warn(string(bytes.TrimSpace(p)))
+	return len(p), nil
+}
+
+// setupMetrics starts the /metrics listener. It serves plain HTTP unless
+// cfg.MetricsTLS is set, in which case the server certificate is used without
+// requiring client certificates.
+func setupMetrics() error {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		metricRequests,
+		metricLookupDuration,
+		metricHandshakeFailures,
+		metricClientLastFetch,
+		bundleCollector{},
+	)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+
+	var tc *tls.Config
+	if cfg.MetricsTLS {
+		tc = &tls.Config{GetCertificate: serverTLS.GetCertificate, MinVersion: tls.VersionTLS12}
+	}
+	if err := common.Serve("Metrics", cfg.MetricsAddr, mux, cfg.Timeout, tc); err != nil {
+		return err
+	}
+	slog.Info("Serving metrics", cs.LogKeyAddr, cfg.MetricsAddr)
+	return nil
+}
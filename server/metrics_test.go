@@ -0,0 +1,109 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	cs "github.com/icemarkom/certsync"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricValues gathers c, and returns the values of its gauges and counters by
+// their first label value, or "" if they have no labels.
+func metricValues(t *testing.T, c prometheus.Collector) map[string]float64 {
+	t.Helper()
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather(): %v", err)
+	}
+	values := make(map[string]float64)
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			var label string
+			if l := m.GetLabel(); len(l) > 0 {
+				label = l[0].GetValue()
+			}
+			values[label] = m.GetGauge().GetValue() + m.GetCounter().GetValue()
+		}
+	}
+	return values
+}
+
+func TestRecordFetch(t *testing.T) {
+	metricClientLastFetch.Reset()
+	fetchClients.Lock()
+	clear(fetchClients.seen)
+	fetchClients.Unlock()
+
+	for i := range maxFetchClients + 10 {
+		recordFetch(cs.Identity{Kind: cs.IdentityDNS, Value: fmt.Sprintf("host%d.example.com", i)})
+	}
+	// Known clients keep their label once the cap is reached.
+	metricClientLastFetch.DeleteLabelValues("host0.example.com")
+	recordFetch(cs.Identity{Kind: cs.IdentityDNS, Value: "host0.example.com"})
+
+	values := metricValues(t, metricClientLastFetch)
+	if len(values) != maxFetchClients+1 {
+		t.Errorf("client labels: want %d, got: %d", maxFetchClients+1, len(values))
+	}
+	for _, client := range []string{"host0.example.com", fmt.Sprintf("host%d.example.com", maxFetchClients-1), fetchClientOther} {
+		if values[client] == 0 {
+			t.Errorf("client %q: want a fetch time, got none", client)
+		}
+	}
+	if _, ok := values[fmt.Sprintf("host%d.example.com", maxFetchClients)]; ok {
+		t.Errorf("client beyond the cap: want no label, got one")
+	}
+}
+
+// TestHandshakeErrorLog checks that net/http still reports handshake failures
+// in the way handshakeErrorLog counts them.
+func TestHandshakeErrorLog(t *testing.T) {
+	slog.SetDefault(slog.New(slog.DiscardHandler))
+	ca := newTestCert(t, "Test CA", nil)
+	srv := newTestCert(t, "localhost", ca)
+	s := httptest.NewUnstartedServer(http.NotFoundHandler())
+	s.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{srv.cert.Raw}, PrivateKey: srv.key}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	s.Config.ErrorLog = log.New(handshakeErrorLog{}, "", 0)
+	s.StartTLS()
+	defer s.Close()
+
+	before := metricValues(t, metricHandshakeFailures)[""]
+	// The client has no certificate, so the server fails the handshake.
+	if conn, err := tls.Dial("tcp", s.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true}); err == nil {
+		conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	for deadline := time.Now().Add(5 * time.Second); metricValues(t, metricHandshakeFailures)[""] == before; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("handshake failure not counted")
+		}
+	}
+}
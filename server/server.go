@@ -17,15 +17,24 @@
 package main
 
 import (
+	"context"
+	"crypto"
 	"crypto/tls"
-	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"log/slog"
 	"math"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	cs "github.com/icemarkom/certsync"
@@ -33,13 +42,29 @@ import (
 )
 
 var (
-	cfg *cs.Config
+	cfg       *cs.Config
+	bundles   atomic.Pointer[cs.BundleStore]
+	serverTLS *cs.ServerTLS
+	issuingCA *cs.CA
+
+	// identityPolicy, trustedProxies and proxyUpstreams are
+	// cfg.IdentityPolicy, cfg.TrustedProxies and cfg.ProxyProtocol, parsed.
+	identityPolicy []string
+	trustedProxies []netip.Prefix
+	proxyUpstreams []netip.Prefix
 
 	binaryName, version, gitCommit string
 )
 
-func init() {
-	var v bool
+// configure reads cfg from the flags, the configuration file and the
+// environment. It is run by main rather than init, so that tests can set up
+// cfg themselves.
+func configure() {
+	var (
+		v, printConfig bool
+		configFile     string
+		verifyAudit    string
+	)
 
 	cfg = cs.NewConfig(binaryName, version, gitCommit)
 
@@ -50,12 +75,45 @@ func init() {
 	flag.StringVar(&cfg.CertFile, "cert", cs.DefaultCertFile, "Certificate file")
 	flag.StringVar(&cfg.CertKeyFile, "key", cs.DefaultKeyFile, "Private key file")
 	flag.StringVar(&cfg.CACertFile, "ca", cs.DefaultCACertFile, "Client CA certificate file")
+	flag.StringVar(&cfg.CRLFile, "crl", "", "Client CRL file, e.g. crl.pem of a certsync_ca directory. Client certificates it revokes are refused. Reloaded with the client CA.")
+	flag.StringVar(&cfg.BundleMapFile, "bundles", "", "Bundle mapping file (JSON). If empty, cert and key are served to all clients.")
+	flag.StringVar(&cfg.IssuingCADir, "issuing_ca", "", "CA directory (see certsync_ca) used to sign client CSRs. If empty, CSRs are not accepted.")
+	flag.DurationVar(&cfg.CSRLifetime, "csr_lifetime", cs.DefaultCSRLifetime*time.Second, "Lifetime of certificates issued for CSRs.")
+	flag.BoolVar(&cfg.CSRServerAuth, "csr_server_auth", false, "Make certificates issued for CSRs usable for server authentication as well. By default they are only good for client authentication.")
+	flag.BoolVar(&cfg.WrapKeys, "wrap_keys", false, "Always encrypt served private keys to the client (see recipients in the bundles file), not only when the client asks for it.")
+	flag.StringVar(&cfg.IdentityPolicy, "identity", cs.DefaultIdentityPolicy, "Comma separated client certificate identities to accept, in order of preference: dns, ip, uri (SANs) and cn.")
+	common.StringsVar(&cfg.TrustedProxies, "trusted_proxy", "Address or CIDR of a proxy whose X-Forwarded-For header is honored. May be repeated.")
+	common.StringsVar(&cfg.ACMEDomains, "acme_domain", "Obtain cert and key from an ACME CA for this domain. May be repeated. Use the bundles file for other bundles.")
+	flag.StringVar(&cfg.ACMEDirectory, "acme_directory", cs.DefaultACMEDirectory, "ACME directory URL.")
+	flag.StringVar(&cfg.ACMEEmail, "acme_email", "", "ACME account contact email.")
+	flag.StringVar(&cfg.ACMEAccountKey, "acme_account_key", "acme_account.key", "ACME account key file. Created if it does not exist.")
+	flag.StringVar(&cfg.ACMECAFile, "acme_ca", "", "CA certificate file to trust for the ACME directory, e.g. for pebble. If empty, system roots are used.")
+	flag.StringVar(&cfg.ACMEHTTPAddr, "acme_http", cs.DefaultACMEHTTPAddr, "Listen address for HTTP-01 ACME challenges.")
+	flag.StringVar(&cfg.ACMEDNSHook, "acme_dns_hook", "", "Shell command that manages DNS-01 TXT records, using CERTSYNC_ACME_ACTION (present or cleanup), CERTSYNC_ACME_RECORD and CERTSYNC_ACME_VALUE. If empty, HTTP-01 is used.")
+	flag.StringVar(&cfg.KeyType, "acme_key_type", cs.DefaultKeyType, "Key type of ACME certificates: ecdsa-p256, ecdsa-p384, ed25519, rsa-2048 or rsa-4096.")
+	common.StringsVar(&cfg.ProxyProtocol, "proxy_protocol", "Address or CIDR of an upstream that sends PROXY protocol (v1 or v2) headers. May be repeated.")
+	common.StringsVar(&cfg.DNSServers, "dns_server", "Name server (host or host:port) to query directly to validate clients, instead of the system resolver. May be repeated. Its answers carry TTLs for -dns_cache.")
+	flag.IntVar(&cfg.DNSCacheSize, "dns_cache", 0, "Cache this many DNS answers used to validate clients. Zero disables the cache.")
+	flag.DurationVar(&cfg.DNSCacheTTL, "dns_cache_ttl", cs.DefaultDNSCacheTTL*time.Second, "How long to cache DNS answers. Caps the TTLs of -dns_server answers.")
+	flag.DurationVar(&cfg.DNSNegativeTTL, "dns_negative_ttl", cs.DefaultDNSNegativeTTL*time.Second, "How long to cache names that do not exist. Caps the negative TTLs of -dns_server answers.")
+	flag.DurationVar(&cfg.DNSTimeout, "dns_timeout", cs.DefaultDNSTimeout*time.Second, "Timeout of each DNS lookup made to validate a client. Clients are answered 503 if DNS does not answer in time.")
+	flag.StringVar(&cfg.MetricsAddr, "metrics", "", "Listen address for Prometheus /metrics, e.g. localhost:9182. If empty, metrics are not served.")
+	flag.BoolVar(&cfg.MetricsTLS, "metrics_tls", false, "Serve /metrics over HTTPS with the server certificate. Client certificates are not required.")
+	flag.StringVar(&cfg.HealthAddr, "health", "", "Listen address for plain HTTP /healthz and /readyz, e.g. :8080. If empty, health checks are not served.")
+	flag.StringVar(&cfg.AuditLogFile, "audit_log", "", "Append a JSON line for every request to this file. If empty, no audit log is written.")
+	flag.BoolVar(&cfg.AuditChain, "audit_chain", false, "Hash chain audit log records, so that altering or removing them is detected by -verify_audit.")
+	flag.StringVar(&verifyAudit, "verify_audit", "", "Verify the hash chain of this audit log file and exit. Every record must be chained.")
 	flag.DurationVar(&cfg.Timeout, "timeout", cs.DefaultTimeout*time.Second, "Server timeout.")
-	flag.BoolVar(&v, "version", false, "Print version and exit.")
+	flag.DurationVar(&cfg.GracePeriod, "grace_period", cs.DefaultGracePeriod*time.Second, "How long to wait for in-flight requests on SIGTERM or SIGINT before closing connections.")
+	flag.DurationVar(&cfg.ReloadInterval, "reload_interval", cs.DefaultReload*time.Second, "How often to check cert, key, CA and CRL files for changes. Zero disables polling; SIGHUP always reloads.")
+	common.LogFlags(cfg)
+	flag.BoolVar(&v, common.FlagVersion, false, "Print version and exit.")
+	flag.StringVar(&configFile, common.FlagConfig, "", "JSON configuration file keyed by flag name. Overridden by CERTSYNC_* environment variables, which are overridden by flags. Read at startup only: SIGHUP reloads the bundles file and TLS material, not this file.")
+	flag.BoolVar(&printConfig, common.FlagPrintConfig, false, "Print the effective configuration and exit.")
 
 	flag.Parse()
 
-	if len(os.Args) == 1 {
+	if !common.Configured(os.Args, os.Environ()) {
 		common.ProgramUsage(cfg)
 		os.Exit(0)
 	}
@@ -65,95 +123,397 @@ func init() {
 		os.Exit(0)
 	}
 
+	if err := common.LoadConfig(configFile, printConfig); err != nil {
+		common.Fatal("Cannot load configuration", cs.ErrAttr(err))
+	}
+	if err := common.SetupLogging(cfg); err != nil {
+		common.Fatal("Invalid configuration", cs.ErrAttr(err))
+	}
+
+	if verifyAudit != "" {
+		n, err := verifyAuditLog(verifyAudit)
+		if err != nil {
+			common.Fatal("Audit log failed verification", cs.LogKeyFile, verifyAudit, cs.ErrAttr(err))
+		}
+		slog.Info("Audit log verified", cs.LogKeyFile, verifyAudit, "records", n)
+		os.Exit(0)
+	}
+
 	if cfg.HostName == "" {
 		h, err := os.Hostname()
 		if err != nil {
-			log.Fatalf("cannot get local hostname: %v", err)
+			common.Fatal("Cannot get local hostname", cs.ErrAttr(err))
 		}
 		cfg.HostName = h
-		log.Printf("Hostname not specified, using default local name: %q.", cfg.HostName)
+		slog.Info("Hostname not specified, using default local name", cs.LogKeyHost, cfg.HostName)
 	}
 	if cfg.Port < 1 && cfg.Port > math.MaxInt16 {
-		log.Printf("Invalid port number: %d.", cfg.Port)
+		slog.Warn("Invalid port number", "port", cfg.Port)
+	}
+	var err error
+	if identityPolicy, err = cs.ParseIdentityPolicy(cfg.IdentityPolicy); err != nil {
+		common.Fatal("Invalid configuration", cs.ErrAttr(err))
+	}
+	if trustedProxies, err = cs.ParseTrustedProxies(cfg.TrustedProxies); err != nil {
+		common.Fatal("Invalid configuration", cs.ErrAttr(fmt.Errorf("-trusted_proxy: %w", err)))
+	}
+	if proxyUpstreams, err = cs.ParseTrustedProxies(cfg.ProxyProtocol); err != nil {
+		common.Fatal("Invalid configuration", cs.ErrAttr(fmt.Errorf("-proxy_protocol: %w", err)))
+	}
+
+	slog.Info("Configuration", cs.LogKeyHost, cfg.HostName, "port", cfg.Port, "cert_file", cfg.CertFile, "key_file", cfg.CertKeyFile, "ca_file", cfg.CACertFile, "bundles_file", cfg.BundleMapFile)
+}
+
+func setupBundles() (*cs.BundleStore, error) {
+	if cfg.BundleMapFile == "" {
+		slog.Info("Bundle mapping file not specified, serving cert and key to all clients", "cert_file", cfg.CertFile, "key_file", cfg.CertKeyFile)
+		return cs.NewBundleStore(cfg), nil
 	}
+	return cs.LoadBundleStore(cfg.BundleMapFile)
+}
 
-	log.Printf("Configuration: host: %q, port: %d, cert file: %q, key file: %q, CA cert: %q.", cfg.HostName, cfg.Port, cfg.CertFile, cfg.CertKeyFile, cfg.CACertFile)
+// setupResolver sets up the resolver used to validate clients: the system or
+// a direct one, timed for metrics, and optionally cached.
+func setupResolver() error {
+	if len(cfg.DNSServers) > 0 {
+		r, err := cs.NewDNSResolver(cfg.DNSServers)
+		if err != nil {
+			return err
+		}
+		r.Timeout = cfg.DNSTimeout
+		cfg.Resolver = r
+		slog.Info("Querying name servers directly", "servers", r.Servers)
+	}
+	cfg.Resolver = newTimedResolver(cfg.Resolver)
+	if cfg.DNSCacheSize > 0 {
+		cfg.Resolver = cs.NewCachingResolver(cfg.Resolver, cfg.DNSCacheSize, cfg.DNSCacheTTL, cfg.DNSNegativeTTL, cfg.DNSTimeout)
+		slog.Info("Caching DNS answers", "size", cfg.DNSCacheSize, "ttl", cfg.DNSCacheTTL, "negative_ttl", cfg.DNSNegativeTTL)
+	}
+	return nil
 }
 
 func setupServer() (*http.Server, error) {
-	ca, err := ioutil.ReadFile(cfg.CACertFile)
+	var err error
+
+	serverTLS, err = cs.NewServerTLS(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("error opening CA certificate file %q: %v", cfg.CACertFile, err)
+		return nil, err
 	}
 
-	caPool := x509.NewCertPool()
-	caPool.AppendCertsFromPEM(ca)
-
 	tc := &tls.Config{
-		ServerName: cfg.HostName,
-		ClientAuth: tls.RequireAndVerifyClientCert,
-		ClientCAs:  caPool,
-		MinVersion: tls.VersionTLS13,
+		ServerName:     cfg.HostName,
+		ClientAuth:     tls.RequireAndVerifyClientCert,
+		GetCertificate: serverTLS.GetCertificate,
+		MinVersion:     tls.VersionTLS13,
 	}
+	tc.GetConfigForClient = serverTLS.ConfigForClient(tc)
 
 	return &http.Server{
 		Addr:         fmt.Sprintf(":%d", cfg.Port),
 		ReadTimeout:  cfg.Timeout,
 		WriteTimeout: cfg.Timeout,
 		TLSConfig:    tc,
+		ErrorLog:     log.New(handshakeErrorLog{}, "", 0),
 	}, nil
 }
 
-func validRequest(r *http.Request) error {
-	cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
-	ip, err := cs.IPFromRequest(r)
+func listen(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(proxyUpstreams) == 0 {
+		return l, nil
+	}
+	slog.Info("Accepting PROXY protocol headers", "upstreams", cfg.ProxyProtocol)
+	return cs.NewProxyListener(l, proxyUpstreams, cfg.Timeout), nil
+}
 
+// handleSignals reloads the bundle mapping file and the TLS material on
+// SIGHUP. Either is kept as is if it fails to load.
+func handleSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		if b, err := setupBundles(); err != nil {
+			slog.Error("Cannot reload certificate bundles on SIGHUP, keeping previous", cs.ErrAttr(err))
+		} else {
+			bundles.Store(b)
+			slog.Info("Certificate bundles reloaded on SIGHUP")
+			select {
+			case acmeReload <- struct{}{}:
+			default:
+			}
+		}
+		if err := serverTLS.Reload(); err != nil {
+			slog.Error("Cannot reload TLS material on SIGHUP, keeping previous", cs.ErrAttr(err))
+			continue
+		}
+		slog.Info("TLS material reloaded on SIGHUP")
+	}
+}
+
+// shutdown stops accepting connections and waits up to cfg.GracePeriod for
+// in-flight requests, so that no bundle is cut off mid-write, before closing
+// the remaining connections.
+func shutdown(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.GracePeriod)
+	defer cancel()
+	slog.Info("Shutting down, waiting for in-flight requests", "grace_period", cfg.GracePeriod)
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Warn("Requests still in flight after grace period, closing", cs.ErrAttr(err))
+		server.Close()
+		return
+	}
+	slog.Info("Server stopped")
+}
+
+// validRequest validates the client address against its certificate, and
+// returns the identity the client is known by. Lookups are canceled with the
+// request.
+func validRequest(r *http.Request) (cs.Identity, error) {
+	ip, err := cs.IPFromRequest(trustedProxies, r)
 	if err != nil {
-		return err
+		return cs.Identity{}, err
+	}
+	id, err := cs.ValidateIdentity(r.Context(), cfg, requestLogger(r), identityPolicy, r.TLS.VerifiedChains[0][0], ip)
+	auditClient(r, ip.String(), id)
+	return id, err
+}
+
+// validationStatus returns the HTTP status for a client validation error:
+// 503 if DNS was unavailable, so that the client retries, and 403 otherwise.
+func validationStatus(err error) int {
+	if errors.Is(err, cs.ErrLookupFailed) {
+		return http.StatusServiceUnavailable
 	}
-	return cs.ValidateAddresses(cfg, cn, ip)
+	return http.StatusForbidden
+}
+
+// requestLogger returns the logger for r, with the connection address and the
+// client certificate CN.
+func requestLogger(r *http.Request) *slog.Logger {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	logger := slog.With(cs.LogKeyRemoteIP, ip)
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		logger = logger.With(cs.LogKeyClientCN, r.TLS.VerifiedChains[0][0].Subject.CommonName)
+	}
+	return logger
 }
 
 func logRequest(r *http.Request) {
-	log.Printf("%s %q request for host %q from client address %q (X-Forwarded-For: %q)",
-		r.Method, r.URL.Path, r.Host, r.RemoteAddr, r.Header.Get("X-Forwarded-For"))
+	requestLogger(r).Info("Request", "method", r.Method, "path", r.URL.Path, cs.LogKeyHost, r.Host, "xff", r.Header.Get("X-Forwarded-For"))
+}
+
+// etagMatch reports whether an If-None-Match header value matches etag.
+func etagMatch(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == etag || t == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// errorWriter writes an error response with the given status code.
+type errorWriter func(w http.ResponseWriter, code int)
+
+func textError(w http.ResponseWriter, code int) {
+	http.Error(w, http.StatusText(code), code)
+}
+
+// reject answers r with status, written by fail, and records the outcome and
+// err in the metrics, the audit log and logger. Server faults are logged as
+// errors, everything else as warnings.
+func reject(w http.ResponseWriter, r *http.Request, fail errorWriter, logger *slog.Logger, status int, outcome string, err error) {
+	fail(w, status)
+	countRequest(r, outcome)
+	auditReason(r, err)
+	level := slog.LevelWarn
+	if status >= 500 && status != http.StatusServiceUnavailable {
+		level = slog.LevelError
+	}
+	logger.Log(r.Context(), level, "Request rejected", "status", status, "outcome", outcome, cs.ErrAttr(err))
+}
+
+// selectBundle validates the client and reads the bundle it asked for. It
+// sets the ETag header, and returns false if a response, either an error
+// written with fail or 304 Not Modified, has already been sent.
+func selectBundle(w http.ResponseWriter, r *http.Request, fail errorWriter) (cs.Identity, *cs.Bundle, []byte, bool) {
+	logger := requestLogger(r)
+	id, err := validRequest(r)
+	if err != nil {
+		reject(w, r, fail, logger, validationStatus(err), validationOutcome(err), err)
+		return id, nil, nil, false
+	}
+	logger = logger.With(cs.LogKeyIdentity, id.String())
+	logger.Info("Client validated")
+	bundle, err := bundles.Load().Select(id.Value, r.URL.Query().Get("bundle"))
+	if errors.Is(err, cs.ErrNoBundle) {
+		reject(w, r, fail, logger, http.StatusNotFound, outcomeNoBundle, err)
+		return id, nil, nil, false
+	}
+	if err != nil {
+		reject(w, r, fail, logger, http.StatusInternalServerError, outcomeError, err)
+		return id, nil, nil, false
+	}
+	logger = logger.With(cs.LogKeyBundle, bundle.Name)
+	data, err := bundle.Read()
+	if err != nil {
+		reject(w, r, fail, logger, http.StatusInternalServerError, outcomeFileError, err)
+		return id, nil, nil, false
+	}
+	auditBundle(r, bundle.Name, data)
+	fp, err := cs.BundleFingerprint(data)
+	if err != nil {
+		reject(w, r, fail, logger, http.StatusInternalServerError, outcomeFileError, err)
+		return id, nil, nil, false
+	}
+	etag := strconv.Quote(fp)
+	w.Header().Set("ETag", etag)
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		countRequest(r, outcomeNotModified)
+		recordFetch(id)
+		logger.Info("Bundle not modified")
+		return id, nil, nil, false
+	}
+	return id, bundle, data, true
+}
+
+// wrapRecipient returns the public key to wrap the served private key to, or
+// nil if the key is served in cleartext. Errors come with the status code to
+// respond with.
+func wrapRecipient(r *http.Request, id cs.Identity) (crypto.PublicKey, int, error) {
+	wrap := r.Header.Get(cs.HeaderKeyWrap)
+	if !cfg.WrapKeys && wrap == "" {
+		return nil, 0, nil
+	}
+	if wrap != "" && wrap != cs.KeyWrapHPKE {
+		return nil, http.StatusNotAcceptable, fmt.Errorf("unsupported key wrapping %q requested", wrap)
+	}
+	pub, err := bundles.Load().Recipient(id.Value)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if pub == nil {
+		pub = r.TLS.VerifiedChains[0][0].PublicKey
+	}
+	return pub, 0, nil
+}
+
+// wrapErrorStatus returns the status code for a key wrapping error.
+func wrapErrorStatus(err error) int {
+	if errors.Is(err, cs.ErrKeyWrap) {
+		return http.StatusNotAcceptable
+	}
+	return http.StatusInternalServerError
 }
 
 func handleRoot(w http.ResponseWriter, r *http.Request) {
 	logRequest(r)
-	if err := validRequest(r); err != nil {
-		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
-		log.Printf("Client IPs did not validate: %v", err)
+	id, bundle, data, ok := selectBundle(w, r, textError)
+	if !ok {
 		return
 	}
-	data, err := ioutil.ReadFile(cfg.CertFile)
+	logger := requestLogger(r).With(cs.LogKeyIdentity, id.String(), cs.LogKeyBundle, bundle.Name)
+	pub, code, err := wrapRecipient(r, id)
 	if err != nil {
-		log.Printf("Error serving cert file: %v", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		reject(w, r, textError, logger, code, outcomeError, err)
 		return
 	}
-	w.Write(data)
-	log.Println("Certificate sent.")
-	data, err = ioutil.ReadFile(cfg.CertKeyFile)
-	if err != nil {
-		log.Printf("Error serving cert key file: %v", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
+	if pub != nil {
+		if data, err = cs.WrapBundle(data, pub); err != nil {
+			reject(w, r, textError, logger, wrapErrorStatus(err), outcomeError, err)
+			return
+		}
+		w.Header().Set(cs.HeaderKeyWrap, cs.KeyWrapHPKE)
 	}
 	w.Write(data)
-	log.Println("Certificate key sent.")
+	countRequest(r, outcomeServed)
+	recordFetch(id)
+	logger.Info("Bundle sent")
 	data = nil
 }
 
 func main() {
+	var err error
+
+	configure()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	b, err := setupBundles()
+	if err != nil {
+		common.Fatal("Unable to load certificate bundles", cs.ErrAttr(err))
+	}
+	bundles.Store(b)
+	var issuer *cs.ACMEIssuer
+	if acme := acmeBundles(); len(acme) > 0 {
+		if issuer, err = setupACME(); err != nil {
+			common.Fatal("Unable to configure ACME", cs.ErrAttr(err))
+		}
+		renewACME(ctx, issuer, acme)
+	}
+	go watchACME(ctx, issuer)
 	server, err := setupServer()
 	if err != nil {
-		log.Fatalf("Unable to configure HTTPS server: %v", err)
+		common.Fatal("Unable to configure HTTPS server", cs.ErrAttr(err))
+	}
+	if err := setupResolver(); err != nil {
+		common.Fatal("Unable to configure DNS resolver", cs.ErrAttr(err))
+	}
+	if cfg.MetricsAddr != "" {
+		if err := setupMetrics(); err != nil {
+			common.Fatal("Unable to serve metrics", cs.ErrAttr(err))
+		}
+	}
+	if cfg.HealthAddr != "" {
+		if err := setupHealth(); err != nil {
+			common.Fatal("Unable to serve health checks", cs.ErrAttr(err))
+		}
+	}
+	if cfg.AuditLogFile != "" {
+		if auditLog, err = cs.OpenAuditLog(cfg.AuditLogFile, cfg.AuditChain); err != nil {
+			common.Fatal("Unable to open audit log", cs.ErrAttr(err))
+		}
+		defer auditLog.Close()
+		server.Handler = auditHandler(http.DefaultServeMux)
+		slog.Info("Writing audit log", cs.LogKeyFile, cfg.AuditLogFile)
 	}
 	http.HandleFunc("/", handleRoot)
+	http.HandleFunc(cs.BundlePathV1, handleBundleV1)
+	if cfg.IssuingCADir != "" {
+		issuingCA, err = cs.LoadCA(cfg.IssuingCADir)
+		if err != nil {
+			common.Fatal("Unable to load issuing CA", cs.ErrAttr(err))
+		}
+		http.HandleFunc(cs.CSRPath, handleCSR)
+		slog.Info("Signing CSRs", "ca", issuingCA.Cert.Subject.String())
+	}
+
+	go handleSignals()
+	if cfg.ReloadInterval > 0 {
+		go serverTLS.Watch(ctx, cfg.ReloadInterval)
+	}
 
-	log.Printf("Starting HTTPS server on host %s:%d", cfg.HostName, cfg.Port)
-	if err := server.ListenAndServeTLS(cfg.CertFile, cfg.CertKeyFile); err != nil {
-		log.Fatal(err)
+	l, err := listen(server.Addr)
+	if err != nil {
+		common.Fatal("Unable to listen", cs.LogKeyAddr, server.Addr, cs.ErrAttr(err))
 	}
+	slog.Info("Starting HTTPS server", cs.LogKeyHost, cfg.HostName, "port", cfg.Port)
+	go func() {
+		if err := server.ServeTLS(l, "", ""); !errors.Is(err, http.ErrServerClosed) {
+			common.Fatal("HTTPS server failed", cs.ErrAttr(err))
+		}
+	}()
+	<-ctx.Done()
+	// A second signal terminates immediately.
+	stop()
+	shutdown(server)
 }
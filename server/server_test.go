@@ -0,0 +1,344 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/go-mockdns"
+	cs "github.com/icemarkom/certsync"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     crypto.Signer
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert issues a certificate for cn, valid for a day. A nil parent
+// makes it a self-signed CA.
+func newTestCert(t *testing.T, cn string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatalf("cannot generate serial: %v", err)
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signerCert, signerKey := tmpl, crypto.Signer(key)
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		tmpl.DNSNames = nil
+	} else {
+		signerCert, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signerCert, key.Public(), signerKey)
+	if err != nil {
+		t.Fatalf("cannot create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("cannot parse certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("cannot marshal key: %v", err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: cs.PEMTypeCertificate, Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: cs.PEMTypePrivateKey, Bytes: keyDER}),
+	}
+}
+
+func writeFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	p := filepath.Join(dir, name)
+	if err := os.WriteFile(p, data, 0600); err != nil {
+		t.Fatalf("cannot write %q: %v", p, err)
+	}
+	return p
+}
+
+// hungResolver never answers before the lookup context is done.
+type hungResolver struct{}
+
+func (hungResolver) LookupAddr(ctx context.Context, _ string) ([]string, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (hungResolver) LookupIPAddr(ctx context.Context, _ string) ([]net.IPAddr, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (hungResolver) LookupHost(ctx context.Context, _ string) ([]string, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func testResolver() cs.Resolver {
+	return &mockdns.Resolver{
+		Zones: map[string]mockdns.Zone{
+			"host.example.com.":      {A: []string{"10.0.0.1"}},
+			"1.0.0.10.in-addr.arpa.": {PTR: []string{"host.example.com."}},
+			"other.example.com.":     {A: []string{"10.0.0.2"}},
+			"2.0.0.10.in-addr.arpa.": {PTR: []string{"other.example.com."}},
+			"nobundle.example.com.":  {A: []string{"10.0.0.3"}},
+			"3.0.0.10.in-addr.arpa.": {PTR: []string{"nobundle.example.com."}},
+			"broken.example.com.":    {Err: errors.New("server failure")},
+		},
+	}
+}
+
+// testServer sets up the server globals with two bundles, web and mail, and
+// returns the handlers, the client CA and the bundles by name.
+func testServer(t *testing.T) (*http.ServeMux, *testCert, map[string][]byte) {
+	t.Helper()
+	slog.SetDefault(slog.New(slog.DiscardHandler))
+	dir := t.TempDir()
+
+	cfg = cs.NewConfig("test_binary", "test_version", "test_commit")
+	cfg.Resolver = testResolver()
+	cfg.DNSTimeout = 50 * time.Millisecond
+	var err error
+	if identityPolicy, err = cs.ParseIdentityPolicy(cfg.IdentityPolicy); err != nil {
+		t.Fatalf("ParseIdentityPolicy(): %v", err)
+	}
+	trustedProxies, proxyUpstreams = nil, nil
+
+	ca := newTestCert(t, "Test CA", nil)
+	data := make(map[string][]byte)
+	for _, name := range []string{"web", "mail"} {
+		b := newTestCert(t, name+".example.com", ca)
+		writeFile(t, dir, name+".pem", b.certPEM)
+		writeFile(t, dir, name+".key", b.keyPEM)
+		data[name] = append(append([]byte{}, b.certPEM...), b.keyPEM...)
+	}
+	store, err := cs.LoadBundleStore(writeFile(t, dir, "bundles.json", []byte(`{
+		"bundles": {
+			"web": {"cert": "`+filepath.Join(dir, "web.pem")+`", "key": "`+filepath.Join(dir, "web.key")+`"},
+			"mail": {"cert": "`+filepath.Join(dir, "mail.pem")+`", "key": "`+filepath.Join(dir, "mail.key")+`"}
+		},
+		"clients": {"host.example.com": ["web", "mail"], "other.example.com": ["mail"]}
+	}`)))
+	if err != nil {
+		t.Fatalf("LoadBundleStore(): %v", err)
+	}
+	bundles.Store(store)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handleRoot)
+	mux.HandleFunc(cs.BundlePathV1, handleBundleV1)
+	return mux, ca, data
+}
+
+// serve sends a request from a client with a verified certificate for cn,
+// connecting from ip.
+func serve(mux *http.ServeMux, ca *testCert, client *testCert, method, target, ip string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	r.RemoteAddr = net.JoinHostPort(ip, "40000")
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{client.cert, ca.cert}}}
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+func TestSelectBundle(t *testing.T) {
+	mux, ca, data := testServer(t)
+	host := newTestCert(t, "host.example.com", ca)
+	other := newTestCert(t, "other.example.com", ca)
+	nobundle := newTestCert(t, "nobundle.example.com", ca)
+
+	var tests = []struct {
+		desc       string
+		client     *testCert
+		ip, query  string
+		wantStatus int
+		wantBundle string
+	}{
+		{desc: "first mapped bundle", client: host, ip: "10.0.0.1", wantStatus: http.StatusOK, wantBundle: "web"},
+		{desc: "requested bundle", client: host, ip: "10.0.0.1", query: "?bundle=mail", wantStatus: http.StatusOK, wantBundle: "mail"},
+		{desc: "other client", client: other, ip: "10.0.0.2", wantStatus: http.StatusOK, wantBundle: "mail"},
+		{desc: "bundle not mapped to client", client: other, ip: "10.0.0.2", query: "?bundle=web", wantStatus: http.StatusNotFound},
+		{desc: "unknown bundle", client: host, ip: "10.0.0.1", query: "?bundle=ftp", wantStatus: http.StatusNotFound},
+		{desc: "client without bundles", client: nobundle, ip: "10.0.0.3", wantStatus: http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		w := serve(mux, ca, tc.client, http.MethodGet, "/"+tc.query, tc.ip, nil)
+		if w.Code != tc.wantStatus {
+			t.Errorf("GET / (%s): want status %d, got: %d", tc.desc, tc.wantStatus, w.Code)
+			continue
+		}
+		if tc.wantBundle != "" && w.Body.String() != string(data[tc.wantBundle]) {
+			t.Errorf("GET / (%s): want bundle %q, got: %q", tc.desc, tc.wantBundle, w.Body)
+		}
+
+		w = serve(mux, ca, tc.client, http.MethodGet, cs.BundlePathV1+tc.query, tc.ip, nil)
+		if w.Code != tc.wantStatus {
+			t.Errorf("GET %s (%s): want status %d, got: %d", cs.BundlePathV1, tc.desc, tc.wantStatus, w.Code)
+			continue
+		}
+		if tc.wantBundle == "" {
+			continue
+		}
+		var resp cs.BundleResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Name != tc.wantBundle {
+			t.Errorf("GET %s (%s): want bundle %q, got: %q (err: %v)", cs.BundlePathV1, tc.desc, tc.wantBundle, resp.Name, err)
+		}
+	}
+}
+
+func TestValidationStatus(t *testing.T) {
+	mux, ca, _ := testServer(t)
+	host := newTestCert(t, "host.example.com", ca)
+	broken := newTestCert(t, "broken.example.com", ca)
+
+	var tests = []struct {
+		desc       string
+		resolver   cs.Resolver
+		client     *testCert
+		ip         string
+		wantStatus int
+	}{
+		{desc: "address mismatch", resolver: testResolver(), client: host, ip: "10.0.0.9", wantStatus: http.StatusForbidden},
+		{desc: "lookup failure", resolver: testResolver(), client: broken, ip: "10.0.0.1", wantStatus: http.StatusServiceUnavailable},
+		{desc: "lookup timeout", resolver: hungResolver{}, client: host, ip: "10.0.0.1", wantStatus: http.StatusServiceUnavailable},
+	}
+	for _, tc := range tests {
+		cfg.Resolver = tc.resolver
+		for _, target := range []string{"/", cs.BundlePathV1} {
+			if w := serve(mux, ca, tc.client, http.MethodGet, target, tc.ip, nil); w.Code != tc.wantStatus {
+				t.Errorf("GET %s (%s): want status %d, got: %d", target, tc.desc, tc.wantStatus, w.Code)
+			}
+		}
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	mux, ca, _ := testServer(t)
+	host := newTestCert(t, "host.example.com", ca)
+
+	for _, target := range []string{"/", cs.BundlePathV1} {
+		w := serve(mux, ca, host, http.MethodGet, target, "10.0.0.1", nil)
+		etag := w.Header().Get("ETag")
+		if w.Code != http.StatusOK || etag == "" {
+			t.Fatalf("GET %s: want 200 with an ETag, got: %d, %q", target, w.Code, etag)
+		}
+		for _, inm := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+			w := serve(mux, ca, host, http.MethodGet, target, "10.0.0.1", http.Header{"If-None-Match": {inm}})
+			if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+				t.Errorf("GET %s with If-None-Match %s: want 304 without body, got: %d, %q", target, inm, w.Code, w.Body)
+			}
+		}
+		w = serve(mux, ca, host, http.MethodGet, target, "10.0.0.1", http.Header{"If-None-Match": {`"other"`}})
+		if w.Code != http.StatusOK {
+			t.Errorf("GET %s with stale If-None-Match: want 200, got: %d", target, w.Code)
+		}
+		// The ETag of the other bundle of the client does not match.
+		w = serve(mux, ca, host, http.MethodGet, target+"?bundle=mail", "10.0.0.1", http.Header{"If-None-Match": {etag}})
+		if w.Code != http.StatusOK {
+			t.Errorf("GET %s?bundle=mail with the ETag of web: want 200, got: %d", target, w.Code)
+		}
+	}
+}
+
+func TestBundleV1(t *testing.T) {
+	mux, ca, data := testServer(t)
+	host := newTestCert(t, "host.example.com", ca)
+
+	w := serve(mux, ca, host, http.MethodGet, cs.BundlePathV1, "10.0.0.1", nil)
+	if ct := w.Header().Get("Content-Type"); w.Code != http.StatusOK || ct != cs.ContentTypeJSON {
+		t.Fatalf("GET %s: want 200 %s, got: %d %s", cs.BundlePathV1, cs.ContentTypeJSON, w.Code, ct)
+	}
+	var resp cs.BundleResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("GET %s: cannot decode response %q: %v", cs.BundlePathV1, w.Body, err)
+	}
+	want, err := cs.NewBundleResponse("web", data["web"])
+	if err != nil {
+		t.Fatalf("NewBundleResponse(): %v", err)
+	}
+	if resp.Version != cs.BundleResponseVersion || resp.Name != want.Name || resp.Leaf != want.Leaf || resp.Key != want.Key ||
+		resp.Fingerprint != want.Fingerprint || resp.Serial != want.Serial || !resp.NotAfter.Equal(want.NotAfter) {
+		t.Errorf("GET %s: want: %+v, got: %+v", cs.BundlePathV1, want, resp)
+	}
+	if pemData, err := resp.PEM(); err != nil || string(pemData) != string(data["web"]) {
+		t.Errorf("GET %s: PEM() of response: want the bundle served at /, got: %q (err: %v)", cs.BundlePathV1, pemData, err)
+	}
+
+	var tests = []struct {
+		desc       string
+		method     string
+		query, ip  string
+		wantStatus int
+	}{
+		{desc: "method not allowed", method: http.MethodPost, ip: "10.0.0.1", wantStatus: http.StatusMethodNotAllowed},
+		{desc: "forbidden", method: http.MethodGet, ip: "10.0.0.9", wantStatus: http.StatusForbidden},
+		{desc: "no bundle", method: http.MethodGet, query: "?bundle=ftp", ip: "10.0.0.1", wantStatus: http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		w := serve(mux, ca, host, tc.method, cs.BundlePathV1+tc.query, tc.ip, nil)
+		var resp cs.ErrorResponse
+		err := json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code != tc.wantStatus || w.Header().Get("Content-Type") != cs.ContentTypeJSON || err != nil || resp.Error != http.StatusText(tc.wantStatus) {
+			t.Errorf("%s %s (%s): want %d with {\"error\": %q}, got: %d %q (err: %v)", tc.method, cs.BundlePathV1, tc.desc, tc.wantStatus, http.StatusText(tc.wantStatus), w.Code, w.Body, err)
+		}
+		if tc.wantStatus == http.StatusMethodNotAllowed && !strings.Contains(w.Header().Get("Allow"), http.MethodGet) {
+			t.Errorf("%s %s: want Allow header with GET, got: %q", tc.method, cs.BundlePathV1, w.Header().Get("Allow"))
+		}
+	}
+}
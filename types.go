@@ -32,6 +32,19 @@ const (
 	DefaultNewCertFile = "newcert.pem"
 	DefaultNewKeyFile  = "newkey.pem"
 	DefaultTimeout     = 30
+	DefaultReload      = 60
+	DefaultRenewJitter = 3600
+	DefaultRetryMin    = 60
+	DefaultRetryMax    = 3600
+	DefaultMaxInterval = 86400
+	DefaultHookTimeout = 60
+	DefaultGracePeriod = 30
+	DefaultDNSTimeout  = 5
+	DefaultCSRLifetime = 90 * 24 * 3600
+
+	// DefaultRenewFraction is the part of the certificate lifetime after which
+	// a daemonized client fetches a new one.
+	DefaultRenewFraction = 2.0 / 3
 
 	PEMTypeCertificate = "CERTIFICATE"
 	PEMTypePrivateKey  = "PRIVATE KEY"
@@ -54,9 +67,26 @@ func NewConfig(b, v, g string) *Config {
 		NewCertFile:    DefaultNewCertFile,
 		NewCertKeyFile: DefaultNewKeyFile,
 		CACertFile:     DefaultCACertFile,
+		IdentityPolicy: DefaultIdentityPolicy,
 		DryRun:         DefaultDryRun,
 		Port:           DefaultPort,
 		Timeout:        DefaultTimeout * time.Second,
+		ReloadInterval: DefaultReload * time.Second,
+		RenewJitter:    DefaultRenewJitter * time.Second,
+		RetryMax:       DefaultRetryMax * time.Second,
+		MaxInterval:    DefaultMaxInterval * time.Second,
+		HookTimeout:    DefaultHookTimeout * time.Second,
+		GracePeriod:    DefaultGracePeriod * time.Second,
+		LogLevel:       DefaultLogLevel,
+		LogFormat:      DefaultLogFormat,
+		LogOutput:      DefaultLogOutput,
+		DNSCacheTTL:    DefaultDNSCacheTTL * time.Second,
+		DNSNegativeTTL: DefaultDNSNegativeTTL * time.Second,
+		DNSTimeout:     DefaultDNSTimeout * time.Second,
+		CSRLifetime:    DefaultCSRLifetime * time.Second,
+		KeyType:        DefaultKeyType,
+		ACMEDirectory:  DefaultACMEDirectory,
+		ACMEHTTPAddr:   DefaultACMEHTTPAddr,
 		BinaryName:     b,
 		Version:        v,
 		GitCommit:      g,
@@ -70,9 +100,54 @@ type Config struct {
 	CertFile, CertKeyFile          string
 	NewCertFile, NewCertKeyFile    string
 	CACertFile                     string
+	CRLFile                        string
+	BundleMapFile                  string
+	BundleName                     string
+	BundleCAFile                   string
+	ExpectedName                   string
+	ServerPins                     []string
+	IdentityPolicy                 string
+	TrustedProxies                 []string
+	ProxyProtocol                  []string
 	DryRun                         bool
+	Daemon                         bool
+	CSR                            bool
+	KeyType                        string
+	WrapKeys                       bool
+	UnwrapKeyFile                  string
+	Hooks                          []string
+	HookTimeout                    time.Duration
 	Port                           int
 	Timeout                        time.Duration
+	ReloadInterval                 time.Duration
+	GracePeriod                    time.Duration
+	RenewJitter                    time.Duration
+	RetryMax                       time.Duration
+	MaxInterval                    time.Duration
+	IssuingCADir                   string
+	CSRLifetime                    time.Duration
+	CSRServerAuth                  bool
+	MetricsAddr                    string
+	MetricsTLS                     bool
+	TextfileName                   string
+	HealthAddr                     string
+	AuditLogFile                   string
+	AuditChain                     bool
+	LogLevel                       string
+	LogFormat                      string
+	LogOutput                      string
+	DNSServers                     []string
+	DNSCacheSize                   int
+	DNSCacheTTL                    time.Duration
+	DNSNegativeTTL                 time.Duration
+	DNSTimeout                     time.Duration
+	ACMEDirectory                  string
+	ACMEEmail                      string
+	ACMEAccountKey                 string
+	ACMECAFile                     string
+	ACMEHTTPAddr                   string
+	ACMEDNSHook                    string
+	ACMEDomains                    []string
 	BinaryName, Version, GitCommit string
 	Resolver                       Resolver
 }
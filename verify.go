@@ -0,0 +1,107 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ErrInvalidBundle is returned when a received bundle fails verification.
+var ErrInvalidBundle = errors.New("invalid certificate bundle")
+
+// VerifyOptions controls VerifyBundle.
+type VerifyOptions struct {
+	// Roots are the trust anchors the chain must build to. If nil, the
+	// system roots are used.
+	Roots *x509.CertPool
+	// DNSName, if not empty, must be among the leaf's SANs.
+	DNSName string
+	// Now is the time used for validity checks. If zero, the current time is
+	// used.
+	Now time.Time
+}
+
+// LoadCertPool returns a pool with all certificates from a PEM file.
+func LoadCertPool(fileName string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CA certificate file %q: %v", fileName, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no CA certificates found in %q", fileName)
+	}
+	return pool, nil
+}
+
+// VerifyBundle checks that the private key matches the leaf certificate, the
+// leaf is currently valid, the chain builds to a trust anchor and, optionally,
+// that the leaf is valid for the expected name. It returns the parsed leaf.
+// All returned errors wrap ErrInvalidBundle.
+func VerifyBundle(certPEM, keyPEM []byte, opts VerifyOptions) (*x509.Certificate, error) {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("%w: certificate and key do not match: %v", ErrInvalidBundle, err)
+	}
+	leaf := pair.Leaf
+	if leaf == nil {
+		if leaf, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("%w: cannot parse leaf certificate: %v", ErrInvalidBundle, err)
+		}
+	}
+
+	now := opts.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	if now.Before(leaf.NotBefore) {
+		return nil, fmt.Errorf("%w: certificate is not valid before %v", ErrInvalidBundle, leaf.NotBefore)
+	}
+	if now.After(leaf.NotAfter) {
+		return nil, fmt.Errorf("%w: certificate expired at %v", ErrInvalidBundle, leaf.NotAfter)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, der := range pair.Certificate[1:] {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("%w: cannot parse chain certificate: %v", ErrInvalidBundle, err)
+		}
+		intermediates.AddCert(c)
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         opts.Roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: chain does not verify: %v", ErrInvalidBundle, err)
+	}
+
+	if opts.DNSName != "" {
+		if err := leaf.VerifyHostname(opts.DNSName); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidBundle, err)
+		}
+	}
+	return leaf, nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"crypto/x509"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestVerifyBundle(t *testing.T) {
+	ca, leaf := newTestChain(t, "host.example.com")
+	otherCA, otherLeaf := newTestChain(t, "host.example.com")
+	now := time.Now()
+	expired := newTestCert(t, "host.example.com", ca, now.Add(-48*time.Hour), now.Add(-24*time.Hour))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	var tests = []struct {
+		desc      string
+		cert, key []byte
+		opts      VerifyOptions
+		wantErr   bool
+	}{
+		{
+			desc: "valid",
+			cert: leaf.certPEM,
+			key:  leaf.keyPEM,
+			opts: VerifyOptions{Roots: roots},
+		},
+		{
+			desc: "valid with name",
+			cert: leaf.certPEM,
+			key:  leaf.keyPEM,
+			opts: VerifyOptions{Roots: roots, DNSName: "host.example.com"},
+		},
+		{
+			desc:    "wrong name",
+			cert:    leaf.certPEM,
+			key:     leaf.keyPEM,
+			opts:    VerifyOptions{Roots: roots, DNSName: "other.example.com"},
+			wantErr: true,
+		},
+		{
+			desc:    "mismatched key",
+			cert:    leaf.certPEM,
+			key:     otherLeaf.keyPEM,
+			opts:    VerifyOptions{Roots: roots},
+			wantErr: true,
+		},
+		{
+			desc:    "untrusted chain",
+			cert:    append(otherLeaf.certPEM, otherCA.certPEM...),
+			key:     otherLeaf.keyPEM,
+			opts:    VerifyOptions{Roots: roots},
+			wantErr: true,
+		},
+		{
+			desc:    "expired",
+			cert:    expired.certPEM,
+			key:     expired.keyPEM,
+			opts:    VerifyOptions{Roots: roots},
+			wantErr: true,
+		},
+		{
+			desc:    "not yet valid",
+			cert:    leaf.certPEM,
+			key:     leaf.keyPEM,
+			opts:    VerifyOptions{Roots: roots, Now: now.Add(-2 * time.Hour)},
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		got, err := VerifyBundle(tc.cert, tc.key, tc.opts)
+		if tc.wantErr {
+			if !errors.Is(err, ErrInvalidBundle) {
+				t.Errorf("VerifyBundle(%s): want ErrInvalidBundle, got: %v", tc.desc, err)
+			}
+			continue
+		}
+		if err != nil || !got.Equal(leaf.cert) {
+			t.Errorf("VerifyBundle(%s): want leaf, got: %v (err: %v)", tc.desc, got, err)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+const (
+	// PEMTypeWrappedKey is the PEM block type of a private key encrypted to
+	// the client with HPKE (RFC 9180).
+	PEMTypeWrappedKey = "CERTSYNC WRAPPED PRIVATE KEY"
+
+	// HeaderKeyWrap is sent by clients that want the private key wrapped, and
+	// by the server when the key in the response is wrapped.
+	HeaderKeyWrap = "X-Certsync-Key-Wrap"
+	KeyWrapHPKE   = "hpke"
+)
+
+// ErrKeyWrap is returned when a key cannot be wrapped for a recipient.
+var ErrKeyWrap = errors.New("cannot wrap private key")
+
+// keyWrapInfo binds wrapped keys to this protocol.
+var keyWrapInfo = []byte("certsync key wrap v1")
+
+// ecdhPublicKey returns the ECDH form of an ECDSA or ECDH public key. Other
+// key types, such as RSA and Ed25519, cannot be used for key agreement.
+func ecdhPublicKey(pub crypto.PublicKey) (*ecdh.PublicKey, error) {
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		return k.ECDH()
+	case *ecdh.PublicKey:
+		return k, nil
+	}
+	return nil, fmt.Errorf("%w: unsupported recipient key type %T", ErrKeyWrap, pub)
+}
+
+func ecdhPrivateKey(priv crypto.PrivateKey) (*ecdh.PrivateKey, error) {
+	switch k := priv.(type) {
+	case *ecdsa.PrivateKey:
+		return k.ECDH()
+	case *ecdh.PrivateKey:
+		return k, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T for unwrapping", priv)
+}
+
+// WrapKey encrypts the PEM encoded private key to pub, which must be an ECDSA
+// or ECDH (e.g. X25519) public key. The result is a single PEM block whose
+// headers name the HPKE ciphersuite.
+func WrapKey(keyPEM []byte, pub crypto.PublicKey) ([]byte, error) {
+	pk, err := ecdhPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	kemID, _, err := hpkeKEM(pk.Curve())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrKeyWrap, err)
+	}
+	ct, err := hpkeSeal(pk, hpkeKDFSHA256, hpkeAEADAES256GCM, keyWrapInfo, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrKeyWrap, err)
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type: PEMTypeWrappedKey,
+		Headers: map[string]string{
+			"KEM":  fmt.Sprintf("0x%04x", kemID),
+			"KDF":  fmt.Sprintf("0x%04x", hpkeKDFSHA256),
+			"AEAD": fmt.Sprintf("0x%04x", hpkeAEADAES256GCM),
+		},
+		Bytes: ct,
+	}), nil
+}
+
+// UnwrapKey decrypts a PEMTypeWrappedKey block with priv, returning the PEM
+// encoded private key.
+func UnwrapKey(block *pem.Block, priv crypto.PrivateKey) ([]byte, error) {
+	k, err := ecdhPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	kemID, _, err := hpkeKEM(k.Curve())
+	if err != nil {
+		return nil, err
+	}
+	var ids [3]uint16
+	for i, h := range []string{"KEM", "KDF", "AEAD"} {
+		id, err := strconv.ParseUint(block.Headers[h], 0, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s header %q in wrapped key", h, block.Headers[h])
+		}
+		ids[i] = uint16(id)
+	}
+	if ids[0] != kemID {
+		return nil, fmt.Errorf("key wrapped with KEM 0x%04x, unwrapping key uses 0x%04x", ids[0], kemID)
+	}
+	keyPEM, err := hpkeOpen(k, ids[1], ids[2], keyWrapInfo, block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot unwrap key: %v", err)
+	}
+	return keyPEM, nil
+}
+
+// WrapBundle returns data with its private key wrapped for pub. Blocks other
+// than certificates and the key are dropped.
+func WrapBundle(data []byte, pub crypto.PublicKey) ([]byte, error) {
+	certPEM, keyPEM, _, err := SplitBundle(data)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := WrapKey(keyPEM, pub)
+	if err != nil {
+		return nil, err
+	}
+	return append(certPEM, wrapped...), nil
+}
+
+// UnwrapBundle replaces every wrapped key in data with its plaintext, leaving
+// other blocks as they are.
+func UnwrapBundle(data []byte, priv crypto.PrivateKey) ([]byte, error) {
+	blocks, err := ParsePEM(data)
+	if err != nil {
+		return nil, err
+	}
+	var out []byte
+	for _, b := range blocks {
+		if b.Type != PEMTypeWrappedKey {
+			out = append(out, pem.EncodeToMemory(b)...)
+			continue
+		}
+		keyPEM, err := UnwrapKey(b, priv)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, keyPEM...)
+	}
+	return out, nil
+}
+
+// ReadUnwrapKey reads a PKCS#8 PEM encoded ECDSA or X25519 private key for
+// UnwrapBundle.
+func ReadUnwrapKey(fileName string) (crypto.PrivateKey, error) {
+	block, err := readPEMBlock(fileName, PEMTypePrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse key file %q: %v", fileName, err)
+	}
+	return k, nil
+}
+
+// ReadPublicKey reads a PEM encoded (PKIX) public key.
+func ReadPublicKey(fileName string) (crypto.PublicKey, error) {
+	block, err := readPEMBlock(fileName, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	k, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse public key file %q: %v", fileName, err)
+	}
+	return k, nil
+}
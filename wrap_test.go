@@ -0,0 +1,123 @@
+// Copyright 2021 CertSync Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package certsync
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"testing"
+)
+
+func TestWrapBundle(t *testing.T) {
+	_, leaf := newTestChain(t, "host.example.com")
+	bundle := append(append([]byte{}, leaf.certPEM...), leaf.keyPEM...)
+
+	x25519, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate X25519 key: %v", err)
+	}
+	p384, err := GenerateKey(KeyECDSAP384)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %v", err)
+	}
+
+	var tests = []struct {
+		desc string
+		priv crypto.PrivateKey
+		pub  crypto.PublicKey
+	}{
+		{desc: "client certificate key", priv: leaf.key, pub: leaf.cert.PublicKey},
+		{desc: "P-384", priv: p384, pub: p384.Public()},
+		{desc: "X25519 recipient", priv: x25519, pub: x25519.PublicKey()},
+	}
+	for _, tc := range tests {
+		wrapped, err := WrapBundle(bundle, tc.pub)
+		if err != nil {
+			t.Errorf("WrapBundle(%s): %v", tc.desc, err)
+			continue
+		}
+		if bytes.Contains(wrapped, leaf.keyPEM) || bytes.Contains(wrapped, []byte("BEGIN "+PEMTypePrivateKey)) {
+			t.Errorf("WrapBundle(%s): cleartext key in %q", tc.desc, wrapped)
+		}
+		got, err := UnwrapBundle(wrapped, tc.priv)
+		if err != nil || !bytes.Equal(got, bundle) {
+			t.Errorf("UnwrapBundle(%s): want: %q, got: %q (err: %v)", tc.desc, bundle, got, err)
+		}
+		if _, err := UnwrapBundle(wrapped, p384); err == nil && tc.priv != p384 {
+			t.Errorf("UnwrapBundle(%s) with wrong key: want error, got nil", tc.desc)
+		}
+	}
+
+	ed, err := GenerateKey(KeyEd25519)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %v", err)
+	}
+	if _, err := WrapBundle(bundle, ed.Public()); !errors.Is(err, ErrKeyWrap) {
+		t.Errorf("WrapBundle(Ed25519): want ErrKeyWrap, got: %v", err)
+	}
+}
+
+func TestBundleStoreRecipient(t *testing.T) {
+	dir := t.TempDir()
+	x25519, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate X25519 key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(x25519.PublicKey())
+	if err != nil {
+		t.Fatalf("cannot marshal public key: %v", err)
+	}
+	pub := writeFile(t, dir, "host.pub", string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})))
+	der, err = x509.MarshalPKCS8PrivateKey(x25519)
+	if err != nil {
+		t.Fatalf("cannot marshal private key: %v", err)
+	}
+	priv := writeFile(t, dir, "host.key", string(pem.EncodeToMemory(&pem.Block{Type: PEMTypePrivateKey, Bytes: der})))
+
+	s, err := LoadBundleStore(writeFile(t, dir, "map.json", `{
+		"bundles": {"web": {"cert": "web.pem", "key": "web.key"}},
+		"clients": {"*": ["web"]},
+		"recipients": {"Host.Example.com": "`+pub+`", "bad.example.com": "`+priv+`"}
+	}`))
+	if err != nil {
+		t.Fatalf("LoadBundleStore(): %v", err)
+	}
+
+	got, err := s.Recipient("host.example.com.")
+	if err != nil || !x25519.PublicKey().Equal(got) {
+		t.Errorf("Recipient(%q): want: %v, got: %v (err: %v)", "host.example.com.", x25519.PublicKey(), got, err)
+	}
+	if got, err := s.Recipient("other.example.com"); got != nil || err != nil {
+		t.Errorf("Recipient(%q): want: nil, got: %v (err: %v)", "other.example.com", got, err)
+	}
+	if _, err := s.Recipient("bad.example.com"); err == nil {
+		t.Errorf("Recipient(%q): want error, got nil", "bad.example.com")
+	}
+
+	key, err := ReadUnwrapKey(priv)
+	if err != nil {
+		t.Fatalf("ReadUnwrapKey(): %v", err)
+	}
+	if !x25519.Equal(key) {
+		t.Errorf("ReadUnwrapKey(): key does not match")
+	}
+}